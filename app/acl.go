@@ -0,0 +1,192 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServerACL is a room's m.room.server_acl. A room without one allows every
+// server.
+type ServerACL struct {
+	Present         bool     `json:"present"`
+	Allow           []string `json:"allow,omitempty"`
+	Deny            []string `json:"deny,omitempty"`
+	AllowIPLiterals bool     `json:"allow_ip_literals"`
+
+	allow []*regexp.Regexp
+	deny  []*regexp.Regexp
+}
+
+func ParseServerACL(content map[string]any) *ServerACL {
+	acl := &ServerACL{
+		Present:         true,
+		AllowIPLiterals: true,
+	}
+
+	acl.Allow = stringList(content["allow"])
+	acl.Deny = stringList(content["deny"])
+
+	if allow, ok := content["allow_ip_literals"].(bool); ok {
+		acl.AllowIPLiterals = allow
+	}
+
+	acl.compile()
+
+	return acl
+}
+
+// compile turns the allow and deny globs into patterns once, rather than for
+// every event the ACL is applied to. Server names are matched in lowercase.
+func (a *ServerACL) compile() {
+	a.allow = make([]*regexp.Regexp, 0, len(a.Allow))
+	for _, glob := range a.Allow {
+		a.allow = append(a.allow, GlobPattern(strings.ToLower(glob)))
+	}
+	a.deny = make([]*regexp.Regexp, 0, len(a.Deny))
+	for _, glob := range a.Deny {
+		a.deny = append(a.deny, GlobPattern(strings.ToLower(glob)))
+	}
+}
+
+func stringList(v any) []string {
+	items, _ := v.([]any)
+	list := make([]string, 0, len(items))
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// IsIPLiteral reports whether a server name, without its port, is an IPv4
+// address or a bracketed IPv6 address.
+func IsIPLiteral(server string) bool {
+	if strings.HasPrefix(server, "[") {
+		return true
+	}
+	return net.ParseIP(server) != nil
+}
+
+// ServerHost strips the port from a server name.
+func ServerHost(server string) string {
+	if strings.HasPrefix(server, "[") {
+		if end := strings.Index(server, "]"); end != -1 {
+			return server[:end+1]
+		}
+		return server
+	}
+	host, _, _ := strings.Cut(server, ":")
+	return host
+}
+
+// Allows applies the ACL to a server name, following the order in the spec:
+// IP literals, then deny rules, then allow rules.
+func (a *ServerACL) Allows(server string) bool {
+	if a == nil || !a.Present {
+		return true
+	}
+
+	host := strings.ToLower(ServerHost(server))
+
+	if !a.AllowIPLiterals && IsIPLiteral(host) {
+		return false
+	}
+
+	for _, pattern := range a.deny {
+		if pattern.MatchString(host) {
+			return false
+		}
+	}
+
+	for _, pattern := range a.allow {
+		if pattern.MatchString(host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllowsSender applies the ACL to the server of an event's sender.
+func (a *ServerACL) AllowsSender(sender string) bool {
+	if sender == "" {
+		return true
+	}
+	return a.Allows(GetDomain(sender))
+}
+
+func serverACLKey(room_id string) string {
+	return fmt.Sprintf("server_acl:%s", room_id)
+}
+
+// RoomServerACL returns the room's current server ACL, from the cache if
+// possible.
+func (c *App) RoomServerACL(room_id id.RoomID) (*ServerACL, error) {
+	ctx := context.Background()
+
+	cached, err := c.Cache.Rooms.Get(ctx, serverACLKey(room_id.String())).Result()
+	if err == nil {
+		var acl ServerACL
+		if err := json.Unmarshal([]byte(cached), &acl); err == nil {
+			acl.compile()
+			return &acl, nil
+		}
+	}
+
+	if err != nil && err != redis.Nil {
+		c.Log.Error().Msgf("Error reading server ACL: %v", err)
+	}
+
+	state, err := c.Matrix.State(ctx, room_id)
+	if err != nil {
+		return nil, err
+	}
+
+	acl := &ServerACL{}
+	if ev := state[event.StateServerACL][""]; ev != nil {
+		acl = ParseServerACL(ev.Content.Raw)
+	}
+
+	ttl := c.Config.Cache.RoomState.ExpireAfter
+	if ttl == 0 {
+		ttl = 3600
+	}
+
+	b, err := json.Marshal(acl)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.Cache.Rooms.Set(ctx, serverACLKey(room_id.String()), b, time.Duration(ttl)*time.Second).Err()
+	if err != nil {
+		c.Log.Error().Msgf("Couldn't cache server ACL %v", err)
+	}
+
+	return acl, nil
+}
+
+// ServerACLChanged drops everything cached under the room's old ACL, so that
+// responses are filtered against the new one.
+func (c *App) ServerACLChanged(room_id id.RoomID) {
+	ctx := context.Background()
+
+	err := c.Cache.Rooms.Del(ctx, serverACLKey(room_id.String())).Err()
+	if err != nil {
+		c.Log.Error().Msgf("Couldn't remove server ACL from cache %v", err)
+	}
+
+	err = c.Cache.Messages.Del(ctx, room_id.String()).Err()
+	if err != nil {
+		c.Log.Error().Msgf("Couldn't remove room messages from cache %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"maunium.net/go/mautrix/event"
+)
+
+type RoomActivity struct {
+	LastEventTS  int64
+	MessageCount int64
+}
+
+func activityKey(room_id string) string {
+	return fmt.Sprintf("activity:%s", room_id)
+}
+
+func messageCountKey(room_id string) string {
+	return fmt.Sprintf("message_count:%s", room_id)
+}
+
+// window for the rolling message count, defaults to a week
+func (c *App) MessageCountWindow() time.Duration {
+	window := c.Config.Activity.MessageWindow
+	if window == 0 {
+		window = 604800
+	}
+	return time.Duration(window) * time.Second
+}
+
+func IsMessageEvent(ev *event.Event) bool {
+	switch ev.Type.Type {
+	case "m.room.message", "m.sticker":
+		return true
+	}
+	return false
+}
+
+// RecordActivity keeps track of a room's last event timestamp and rolling
+// message count as events arrive in transactions.
+func (c *App) RecordActivity(ev *event.Event) error {
+	if ev.RoomID == "" || ev.Timestamp == 0 {
+		return nil
+	}
+
+	room_id := ev.RoomID.String()
+	ctx := context.Background()
+
+	// only move the last event timestamp forward
+	last, err := c.Cache.Rooms.HGet(ctx, activityKey(room_id), "last_event_ts").Int64()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	if ev.Timestamp > last {
+		err = c.Cache.Rooms.HSet(ctx, activityKey(room_id), "last_event_ts", ev.Timestamp).Err()
+		if err != nil {
+			return err
+		}
+	}
+
+	if !IsMessageEvent(ev) {
+		return nil
+	}
+
+	window := c.MessageCountWindow()
+	cutoff := time.Now().Add(-window).UnixMilli()
+
+	pipe := c.Cache.Rooms.TxPipeline()
+	pipe.ZAdd(ctx, messageCountKey(room_id), redis.Z{
+		Score:  float64(ev.Timestamp),
+		Member: ev.ID.String(),
+	})
+	pipe.ZRemRangeByScore(ctx, messageCountKey(room_id), "-inf", strconv.FormatInt(cutoff, 10))
+	pipe.Expire(ctx, messageCountKey(room_id), window)
+	_, err = pipe.Exec(ctx)
+
+	return err
+}
+
+// GetRoomActivity returns the recorded activity for a set of rooms, keyed by
+// room ID. Rooms without any recorded activity are left out.
+func (c *App) GetRoomActivity(room_ids ...string) (map[string]*RoomActivity, error) {
+	ctx := context.Background()
+
+	cutoff := strconv.FormatInt(time.Now().Add(-c.MessageCountWindow()).UnixMilli(), 10)
+
+	pipe := c.Cache.Rooms.Pipeline()
+
+	last := make([]*redis.StringCmd, len(room_ids))
+	counts := make([]*redis.IntCmd, len(room_ids))
+
+	for i, room_id := range room_ids {
+		last[i] = pipe.HGet(ctx, activityKey(room_id), "last_event_ts")
+		counts[i] = pipe.ZCount(ctx, messageCountKey(room_id), cutoff, "+inf")
+	}
+
+	_, err := pipe.Exec(ctx)
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	activity := make(map[string]*RoomActivity, len(room_ids))
+
+	for i, room_id := range room_ids {
+		ts, _ := last[i].Int64()
+		count, _ := counts[i].Result()
+
+		if ts == 0 && count == 0 {
+			continue
+		}
+
+		activity[room_id] = &RoomActivity{
+			LastEventTS:  ts,
+			MessageCount: count,
+		}
+	}
+
+	return activity, nil
+}
+
+// AttachRoomActivity fills in the activity fields of public rooms. The last
+// activity derived from room state is kept if it's more recent.
+func (c *App) AttachRoomActivity(rooms []PublicRoom) {
+	if len(rooms) == 0 {
+		return
+	}
+
+	room_ids := make([]string, 0, len(rooms))
+	for _, room := range rooms {
+		room_ids = append(room_ids, room.RoomID)
+	}
+
+	activity, err := c.GetRoomActivity(room_ids...)
+	if err != nil {
+		c.Log.Error().Msgf("Error fetching room activity: %v", err)
+		return
+	}
+
+	for i := range rooms {
+		a, ok := activity[rooms[i].RoomID]
+		if !ok {
+			continue
+		}
+		rooms[i].LastActivityTS = max(rooms[i].LastActivityTS, a.LastEventTS)
+		rooms[i].MessageCount = a.MessageCount
+	}
+}
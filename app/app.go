@@ -3,6 +3,7 @@ package app
 import (
 	"context"
 	"fmt"
+	"html/template"
 	"log"
 	"net/http"
 	"os"
@@ -34,6 +35,10 @@ type App struct {
 	Cache  *Cache
 	Log    *zerolog.Logger
 	Matrix *mautrix.Client
+	Policy *PolicyLists
+
+	// page templates by name
+	Templates map[string]*template.Template
 }
 
 func (c *App) Activate() {
@@ -66,6 +71,8 @@ func (c *App) Activate() {
 type StartRequest struct {
 	Config          string
 	JoinPublicRooms bool
+	// local moderation command and its arguments, run instead of the server
+	Moderation []string
 }
 
 var CONFIG_FILE string
@@ -116,14 +123,26 @@ func Start(s *StartRequest) {
 		Cache:  cache,
 		Log:    logger,
 		Matrix: client,
+		Policy: NewPolicyLists(),
 	}
 
+	c.Templates = c.NewTemplates()
+
 	if s.JoinPublicRooms {
 		log.Println("Joining public rooms")
 		c.JoinPublicRooms()
 		os.Exit(1)
 	}
 
+	if len(s.Moderation) > 0 {
+		err := c.RunModerationCommand(s.Moderation, os.Getenv("USER"))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	c.Setup()
 
 	c.Routes()
@@ -133,7 +152,14 @@ func Start(s *StartRequest) {
 	// c.Build()
 
 	// go c.Cron.AddFunc("*/15 * * * *", c.RefreshCache)
-	// go c.Cron.Start()
+	c.Cron.AddFunc("@hourly", c.CleanMediaCache)
+	if c.Config.Pages.Enabled {
+		if _, err := c.Cron.AddFunc(c.SitemapSchedule(), c.GenerateSitemaps); err != nil {
+			log.Fatal(err)
+		}
+		go c.GenerateSitemaps()
+	}
+	go c.Cron.Start()
 
 	c.Activate()
 }
@@ -0,0 +1,120 @@
+package app
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+)
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+func encodeBase83(value, length int) string {
+	var b strings.Builder
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		b.WriteByte(base83Chars[digit])
+	}
+	return b.String()
+}
+
+func srgbToLinear(v uint32) float64 {
+	c := float64(v>>8) / 255
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+func linearToSrgb(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+// EncodeBlurhash encodes an image as a blurhash with the given number of
+// components on each axis. Images should be scaled down first, since every
+// pixel is visited once per component.
+func EncodeBlurhash(img image.Image, x_components, y_components int) (string, error) {
+	if x_components < 1 || x_components > 9 || y_components < 1 || y_components > 9 {
+		return "", fmt.Errorf("blurhash components must be between 1 and 9")
+	}
+
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width == 0 || height == 0 {
+		return "", fmt.Errorf("empty image")
+	}
+
+	// linear colour of every pixel, read once
+	pixels := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			pixels[y*width+x] = [3]float64{srgbToLinear(r), srgbToLinear(g), srgbToLinear(bl)}
+		}
+	}
+
+	factors := make([][3]float64, 0, x_components*y_components)
+
+	for j := 0; j < y_components; j++ {
+		for i := 0; i < x_components; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+
+			var f [3]float64
+			for y := 0; y < height; y++ {
+				basis_y := math.Cos(math.Pi * float64(j) * float64(y) / float64(height))
+				for x := 0; x < width; x++ {
+					basis := normalisation * math.Cos(math.Pi*float64(i)*float64(x)/float64(width)) * basis_y
+					p := pixels[y*width+x]
+					f[0] += basis * p[0]
+					f[1] += basis * p[1]
+					f[2] += basis * p[2]
+				}
+			}
+
+			scale := 1 / float64(width*height)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	var hash strings.Builder
+
+	hash.WriteString(encodeBase83((x_components-1)+(y_components-1)*9, 1))
+
+	dc := factors[0]
+	ac := factors[1:]
+
+	max_value := 1.0
+	if len(ac) > 0 {
+		actual_max := 0.0
+		for _, f := range ac {
+			actual_max = math.Max(actual_max, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+		quantised_max := int(math.Max(0, math.Min(82, math.Floor(actual_max*166-0.5))))
+		max_value = float64(quantised_max+1) / 166
+		hash.WriteString(encodeBase83(quantised_max, 1))
+	} else {
+		hash.WriteString(encodeBase83(0, 1))
+	}
+
+	hash.WriteString(encodeBase83((linearToSrgb(dc[0])<<16)+(linearToSrgb(dc[1])<<8)+linearToSrgb(dc[2]), 4))
+
+	for _, f := range ac {
+		quant := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/max_value, 0.5)*9+9.5))))
+		}
+		hash.WriteString(encodeBase83(quant(f[0])*19*19+quant(f[1])*19+quant(f[2]), 2))
+	}
+
+	return hash.String(), nil
+}
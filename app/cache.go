@@ -1,6 +1,7 @@
 package app
 
 import (
+	"bytes"
 	config "commune/config"
 	"context"
 	"encoding/json"
@@ -74,15 +75,40 @@ func NewCache(conf *config.Config) (*Cache, error) {
 	return c, nil
 }
 
-func (c *App) CacheEvent(event_id id.EventID, event any) error {
+func roomEventsKey(room_id id.RoomID) string {
+	return fmt.Sprintf("room_events:%s", room_id)
+}
+
+func (c *App) CacheEvent(room_id id.RoomID, event_id id.EventID, event any) error {
 	err := c.Cache.Events.Set(context.Background(), event_id.String(), event, 0).Err()
 	if err != nil {
 		c.Log.Error().Msgf("Couldn't cache room %v", err)
 		return err
 	}
+
+	// index events by room, so they can be purged along with the room
+	err = c.Cache.Events.SAdd(context.Background(), roomEventsKey(room_id), event_id.String()).Err()
+	if err != nil {
+		c.Log.Error().Msgf("Couldn't index cached event %v", err)
+		return err
+	}
+
 	return nil
 }
 
+// UncacheEvent forgets a cached event once it's redacted, so that the
+// gallery and other readers of the cache never see its old content.
+func (c *App) UncacheEvent(room_id id.RoomID, event_id id.EventID) error {
+	ctx := context.Background()
+
+	pipe := c.Cache.Events.Pipeline()
+	pipe.Del(ctx, event_id.String())
+	pipe.SRem(ctx, roomEventsKey(room_id), event_id.String())
+	_, err := pipe.Exec(ctx)
+
+	return err
+}
+
 func (c *App) AddRoomToCache(room *RoomInfo) error {
 
 	i, err := json.Marshal(room)
@@ -136,6 +162,74 @@ func (c *App) RemoveRoomFromCache(room_id id.RoomID) error {
 	return nil
 }
 
+// PurgeRoom removes everything we've cached about a room from the rooms,
+// state, messages and events caches.
+func (c *App) PurgeRoom(room_id id.RoomID) error {
+	ctx := context.Background()
+
+	c.Log.Info().Msgf("Purging room from caches: %v", room_id)
+
+	cached, err := c.Cache.Rooms.Get(ctx, room_id.String()).Result()
+	if err == nil && cached != "" {
+		var info RoomInfo
+		if err := json.Unmarshal([]byte(cached), &info); err == nil && info.CanonicalAlias != "" {
+			err = c.Cache.Rooms.Del(ctx, info.CanonicalAlias).Err()
+			if err != nil {
+				c.Log.Error().Msgf("Couldn't remove room alias from cache %v", err)
+				return err
+			}
+		}
+	}
+
+	keys := []string{
+		room_id.String(),
+		activityKey(room_id.String()),
+		messageCountKey(room_id.String()),
+		visibilityKey(room_id.String()),
+		serverACLKey(room_id.String()),
+		cardKey(room_id.String()),
+		threadsKey(room_id.String()),
+	}
+	keys = append(keys, galleryKeys(room_id.String())...)
+
+	err = c.Cache.Rooms.Del(ctx, keys...).Err()
+	if err != nil {
+		c.Log.Error().Msgf("Couldn't remove room from cache %v", err)
+		return err
+	}
+
+	err = c.Cache.State.Del(ctx, room_id.String()).Err()
+	if err != nil {
+		c.Log.Error().Msgf("Couldn't remove room state from cache %v", err)
+		return err
+	}
+
+	err = c.Cache.Messages.Del(ctx, room_id.String()).Err()
+	if err != nil {
+		c.Log.Error().Msgf("Couldn't remove room messages from cache %v", err)
+		return err
+	}
+
+	iter := c.Cache.Events.SScan(ctx, roomEventsKey(room_id), 0, "", 500).Iterator()
+	batch := []string{}
+	for iter.Next(ctx) {
+		batch = append(batch, iter.Val())
+		if len(batch) == 500 {
+			c.Cache.Events.Del(ctx, batch...)
+			batch = []string{}
+		}
+	}
+	if len(batch) > 0 {
+		c.Cache.Events.Del(ctx, batch...)
+	}
+	if err := iter.Err(); err != nil {
+		c.Log.Error().Msgf("Couldn't remove room events from cache %v", err)
+		return err
+	}
+
+	return c.Cache.Events.Del(ctx, roomEventsKey(room_id)).Err()
+}
+
 func (c *App) CachePublicRooms(public_rooms any) error {
 
 	json, err := json.Marshal(public_rooms)
@@ -163,6 +257,8 @@ func (c *App) CachePublicRooms(public_rooms any) error {
 func (c *App) RebuildPublicRoomsCache() error {
 	public_rooms, err := c.GetPublicRooms()
 	if err != nil {
+		// keep the existing cache rather than replace it with partial results
+		c.Log.Error().Msgf("Couldn't rebuild public rooms cache: %v", err)
 		return err
 	}
 
@@ -213,7 +309,20 @@ func (c *App) CacheRoomMessages(room_id string) error {
 		return err
 	}
 
-	err = c.Cache.Messages.Set(context.Background(), room_id, json, 60*time.Minute).Err()
+	// the proxy serves this as it is, so it's filtered like its own responses
+	filtered, _, err := c.FilterTimelineResponse(id.RoomID(room_id), json)
+	if err != nil {
+		c.Log.Error().Msgf("Couldn't filter messages %v", err)
+		return err
+	}
+
+	var sanitized bytes.Buffer
+	if err := c.Sanitizer().Stream(&sanitized, bytes.NewReader(filtered), ""); err != nil {
+		c.Log.Error().Msgf("Couldn't sanitize messages %v", err)
+		return err
+	}
+
+	err = c.Cache.Messages.Set(context.Background(), room_id, sanitized.String(), 60*time.Minute).Err()
 	if err != nil {
 		c.Log.Error().Msgf("Couldn't cache messages %v", err)
 		return err
@@ -0,0 +1,521 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+	"maunium.net/go/mautrix/id"
+)
+
+// the size link previews expect
+const (
+	CardWidth  = 1200
+	CardHeight = 630
+)
+
+// bumped when the layout changes, so cards cached with the old one aren't
+// served
+const cardVersion = 1
+
+// room cards are recorded for a day at most, so that changes that aren't seen in
+// transactions, such as a renamed parent space, still show up
+const cardTTL = 24 * time.Hour
+
+const cardPadding = 80
+
+// Card is everything shown on a preview image. Its hash decides whether a
+// cached image can be reused.
+type Card struct {
+	RoomID    string `json:"room_id"`
+	RoomName  string `json:"room_name"`
+	SpaceName string `json:"space_name,omitempty"`
+	AvatarURL string `json:"avatar_url,omitempty"`
+	Sender    string `json:"sender,omitempty"`
+	Text      string `json:"text,omitempty"`
+	SiteName  string `json:"site_name,omitempty"`
+	Version   int    `json:"version"`
+}
+
+func (card *Card) Hash() string {
+	b, _ := json.Marshal(card)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// the hash of a room's current card. Event cards aren't recorded, since the
+// event has to be checked on every request anyway.
+func cardKey(room_id string) string {
+	return fmt.Sprintf("card:%s", room_id)
+}
+
+// InvalidateRoomCard forgets a room's card after its name, avatar or topic
+// changes. Images stay in the media cache until they're cleaned, since
+// identical cards share them.
+func (c *App) InvalidateRoomCard(room_id id.RoomID) {
+	err := c.Cache.Rooms.Del(context.Background(), cardKey(room_id.String())).Err()
+	if err != nil {
+		c.Log.Error().Msgf("Couldn't invalidate room cards: %v", err)
+	}
+}
+
+type cardFaces struct {
+	name    font.Face
+	space   font.Face
+	sender  font.Face
+	text    font.Face
+	footer  font.Face
+	initial font.Face
+}
+
+var (
+	loadCardFaces sync.Once
+	faces         *cardFaces
+	facesErr      error
+)
+
+// CardFaces loads the Go fonts at the sizes cards use. They're bundled with
+// x/image, so rendering needs no system fonts.
+func CardFaces() (*cardFaces, error) {
+	loadCardFaces.Do(func() {
+		regular, err := opentype.Parse(goregular.TTF)
+		if err != nil {
+			facesErr = err
+			return
+		}
+		bold, err := opentype.Parse(gobold.TTF)
+		if err != nil {
+			facesErr = err
+			return
+		}
+
+		face := func(f *opentype.Font, size float64) font.Face {
+			if facesErr != nil {
+				return nil
+			}
+			var ff font.Face
+			ff, facesErr = opentype.NewFace(f, &opentype.FaceOptions{
+				Size:    size,
+				DPI:     72,
+				Hinting: font.HintingFull,
+			})
+			return ff
+		}
+
+		faces = &cardFaces{
+			name:    face(bold, 60),
+			space:   face(regular, 32),
+			sender:  face(bold, 40),
+			text:    face(regular, 36),
+			footer:  face(regular, 28),
+			initial: face(bold, 80),
+		}
+	})
+	return faces, facesErr
+}
+
+// CardColor picks a background for a room from its ID, so each room keeps
+// the same colour.
+func CardColor(room_id string) color.RGBA {
+	h := fnv.New32a()
+	h.Write([]byte(room_id))
+	hue := float64(h.Sum32()%360) / 360
+
+	// dark enough for white text
+	r, g, b := hslToRGB(hue, 0.45, 0.28)
+	return color.RGBA{r, g, b, 255}
+}
+
+func hslToRGB(h, s, l float64) (uint8, uint8, uint8) {
+	q := l * (1 + s)
+	if l >= 0.5 {
+		q = l + s - l*s
+	}
+	p := 2*l - q
+
+	channel := func(t float64) uint8 {
+		if t < 0 {
+			t++
+		}
+		if t > 1 {
+			t--
+		}
+		var v float64
+		switch {
+		case t < 1.0/6:
+			v = p + (q-p)*6*t
+		case t < 1.0/2:
+			v = q
+		case t < 2.0/3:
+			v = p + (q-p)*(2.0/3-t)*6
+		default:
+			v = p
+		}
+		return uint8(v*255 + 0.5)
+	}
+
+	return channel(h + 1.0/3), channel(h), channel(h - 1.0/3)
+}
+
+// circle masks an image to a circle of the given diameter.
+type circle struct {
+	d int
+}
+
+func (c *circle) ColorModel() color.Model { return color.AlphaModel }
+func (c *circle) Bounds() image.Rectangle { return image.Rect(0, 0, c.d, c.d) }
+func (c *circle) At(x, y int) color.Color {
+	r := float64(c.d) / 2
+	dx, dy := float64(x)+0.5-r, float64(y)+0.5-r
+	if dx*dx+dy*dy <= r*r {
+		return color.Alpha{255}
+	}
+	return color.Alpha{0}
+}
+
+// RenderCard draws a card as a PNG. The avatar is optional; without one the
+// first letter of the room's name stands in.
+func RenderCard(card *Card, avatar image.Image) ([]byte, error) {
+	f, err := CardFaces()
+	if err != nil {
+		return nil, err
+	}
+
+	bg := CardColor(card.RoomID)
+	dst := image.NewRGBA(image.Rect(0, 0, CardWidth, CardHeight))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+
+	white := image.NewUniform(color.White)
+	muted := image.NewUniform(color.NRGBA{255, 255, 255, 190})
+
+	const avatar_size = 160
+	avatar_rect := image.Rect(cardPadding, cardPadding, cardPadding+avatar_size, cardPadding+avatar_size)
+	mask := &circle{d: avatar_size}
+
+	if avatar != nil {
+		square := CropImage(avatar, avatar_size, avatar_size)
+		scaled := image.NewRGBA(image.Rect(0, 0, avatar_size, avatar_size))
+		draw.CatmullRom.Scale(scaled, scaled.Bounds(), square, square.Bounds(), draw.Src, nil)
+		draw.DrawMask(dst, avatar_rect, scaled, image.Point{}, mask, image.Point{}, draw.Over)
+	} else {
+		light := color.RGBA{bg.R/2 + 100, bg.G/2 + 100, bg.B/2 + 100, 255}
+		draw.DrawMask(dst, avatar_rect, image.NewUniform(light), image.Point{}, mask, image.Point{}, draw.Over)
+
+		initial := strings.ToUpper(firstRune(supportedText(f.initial, card.RoomName)))
+		w := font.MeasureString(f.initial, initial).Round()
+		drawText(dst, f.initial, white, initial,
+			avatar_rect.Min.X+(avatar_size-w)/2,
+			avatar_rect.Min.Y+avatar_size/2+f.initial.Metrics().CapHeight.Round()/2)
+	}
+
+	// the room's name, and the space it's in above it
+	x := avatar_rect.Max.X + 40
+	width := CardWidth - cardPadding - x
+	y := cardPadding + 40
+
+	if card.SpaceName != "" {
+		line := wrapText(f.space, card.SpaceName, width, 1)
+		drawText(dst, f.space, muted, line[0], x, y)
+		y += 64
+	} else {
+		y += 30
+	}
+
+	for _, line := range wrapText(f.name, card.RoomName, width, 2) {
+		drawText(dst, f.name, white, line, x, y)
+		y += 70
+	}
+
+	// the message or topic, below the avatar
+	y = max(y, avatar_rect.Max.Y+40) + 20
+	width = CardWidth - 2*cardPadding
+
+	text_lines := 5
+	if card.Sender != "" {
+		drawText(dst, f.sender, white, wrapText(f.sender, card.Sender, width, 1)[0], cardPadding, y)
+		y += 56
+		text_lines = 3
+	}
+
+	footer_y := CardHeight - 50
+	for _, line := range wrapText(f.text, card.Text, width, text_lines) {
+		if y > footer_y-56 {
+			break
+		}
+		drawText(dst, f.text, muted, line, cardPadding, y)
+		y += 46
+	}
+
+	if card.SiteName != "" {
+		drawText(dst, f.footer, muted, card.SiteName, cardPadding, footer_y)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, dst); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func drawText(dst *image.RGBA, face font.Face, src image.Image, s string, x, y int) {
+	d := &font.Drawer{
+		Dst:  dst,
+		Src:  src,
+		Face: face,
+		Dot:  fixed.P(x, y),
+	}
+	d.DrawString(supportedText(face, s))
+}
+
+// supportedText drops the characters a face has no glyphs for, such as
+// emoji, rather than drawing boxes for them.
+func supportedText(face font.Face, s string) string {
+	return strings.Map(func(r rune) rune {
+		if _, ok := face.GlyphAdvance(r); !ok {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+func firstRune(s string) string {
+	r, size := utf8.DecodeRuneInString(s)
+	if size == 0 || r == utf8.RuneError {
+		return ""
+	}
+	return string(r)
+}
+
+// wrapText breaks text into at most max_lines lines that fit within width,
+// ending the last with an ellipsis if the text doesn't fit.
+func wrapText(face font.Face, s string, width int, max_lines int) []string {
+	words := strings.Fields(supportedText(face, s))
+	limit := fixed.I(width)
+
+	fits := func(s string) bool {
+		return font.MeasureString(face, s) <= limit
+	}
+
+	lines := []string{}
+	line := ""
+
+	for i := 0; i < len(words); i++ {
+		word := words[i]
+
+		candidate := word
+		if line != "" {
+			candidate = line + " " + word
+		}
+		if fits(candidate) {
+			line = candidate
+			continue
+		}
+
+		if line == "" {
+			// a single word wider than the line is broken where it overflows
+			runes := []rune(word)
+			n := len(runes)
+			for n > 1 && !fits(string(runes[:n])) {
+				n--
+			}
+			line = string(runes[:n])
+			words[i] = string(runes[n:])
+			i--
+		} else {
+			i--
+		}
+
+		lines = append(lines, line)
+		line = ""
+
+		if len(lines) == max_lines {
+			last := lines[max_lines-1]
+			for last != "" && !fits(last+"…") {
+				runes := []rune(last)
+				last = strings.TrimRight(string(runes[:len(runes)-1]), " ")
+			}
+			lines[max_lines-1] = last + "…"
+			return lines
+		}
+	}
+
+	if line != "" || len(lines) == 0 {
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// NewRoomCard describes a room's card, or an event's if ev is given.
+func (c *App) NewRoomCard(page *Page, ev *PageEvent) *Card {
+	card := &Card{
+		RoomID:    page.Room.RoomID,
+		RoomName:  page.Name,
+		AvatarURL: page.Room.AvatarURL,
+		Text:      page.Room.Topic,
+		SiteName:  c.SiteName(),
+		Version:   cardVersion,
+	}
+
+	if len(page.Parents) > 0 {
+		card.SpaceName = page.Parents[0].Name
+	}
+
+	if ev != nil {
+		card.Sender = ev.Author()
+		card.Text = ev.Text
+		if ev.Kind != "text" && ev.Kind != "notice" && ev.Kind != "emote" {
+			card.Text = ev.Filename
+		}
+	}
+
+	return card
+}
+
+// CardImage returns the PNG for a card, from the media cache if it has
+// already been drawn.
+func (c *App) CardImage(ctx context.Context, card *Card) (*CachedMedia, error) {
+	key := "card/" + card.Hash()
+
+	cache := c.MediaCache()
+
+	if cached, err := cache.Get(key); err == nil {
+		return cached, nil
+	}
+
+	var avatar image.Image
+	if card.AvatarURL != "" {
+		img, release, err := c.OriginalImage(ctx, card.AvatarURL)
+		if err != nil {
+			c.Log.Info().Msgf("Couldn't load avatar for card: %v", err)
+		} else {
+			defer release()
+			avatar = img
+		}
+	}
+
+	b, err := RenderCard(card, avatar)
+	if err != nil {
+		return nil, err
+	}
+
+	return cache.Put(key, bytes.NewReader(b), MediaMeta{
+		ContentType: "image/png",
+	})
+}
+
+func RoomCardPath(room_id string) string {
+	return "/view/card/room/" + pathSegment(room_id)
+}
+
+func EventCardPath(room_id, event_id string) string {
+	return RoomCardPath(room_id) + "/event/" + pathSegment(event_id)
+}
+
+// CardProxy serves the preview image for a room, or for an event in it.
+func (c *App) CardProxy() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		room_id, ok := c.pageRoom(w, r)
+		if !ok {
+			return
+		}
+
+		event_id, err := url.PathUnescape(chi.URLParam(r, "event_id"))
+		if err != nil {
+			c.RenderErrorPage(w, http.StatusNotFound, "Message not found")
+			return
+		}
+
+		ctx := r.Context()
+
+		// a card that's already been drawn for the room's current state
+		if event_id == "" {
+			if hash, err := c.Cache.Rooms.Get(ctx, cardKey(room_id.String())).Result(); err == nil {
+				if cached, err := c.MediaCache().Get("card/" + hash); err == nil {
+					defer cached.Close()
+					serveCard(w, r, cached)
+					return
+				}
+			}
+		}
+
+		if event_id != "" {
+			endpoints, err := c.RoomEndpoints(room_id)
+			if err != nil || !endpoints.Allows("messages") || c.EndpointDisabled(room_id, "event") {
+				c.RenderErrorPage(w, http.StatusNotFound, "Message not found")
+				return
+			}
+		}
+
+		resolved, ok := c.resolvePage(w, &RoomInfoOptions{
+			RoomID:  room_id.String(),
+			EventID: event_id,
+		})
+		if !ok {
+			return
+		}
+
+		page, _ := c.NewPage(resolved)
+
+		var ev *PageEvent
+		if event_id != "" {
+			if resolved.Event != nil {
+				ev = c.NewPageEvent(room_id.String(), resolved.Event)
+			}
+			if ev == nil {
+				c.RenderErrorPage(w, http.StatusNotFound, "Message not found")
+				return
+			}
+			if resolved.Sender != nil {
+				ev.SenderName = resolved.Sender.DisplayName
+			}
+		}
+
+		card := c.NewRoomCard(page, ev)
+
+		cached, err := c.CardImage(ctx, card)
+		if err != nil {
+			c.Log.Error().Msgf("Error rendering card: %v", err)
+			c.RenderErrorPage(w, http.StatusInternalServerError, "Couldn't draw this preview")
+			return
+		}
+		defer cached.Close()
+
+		if event_id == "" {
+			err := c.Cache.Rooms.Set(ctx, cardKey(room_id.String()), card.Hash(), cardTTL).Err()
+			if err != nil {
+				c.Log.Error().Msgf("Couldn't record card: %v", err)
+			}
+		}
+
+		serveCard(w, r, cached)
+	}
+}
+
+func serveCard(w http.ResponseWriter, r *http.Request, cached *CachedMedia) {
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", cached.Meta.Fetched, cached.File)
+}
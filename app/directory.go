@@ -0,0 +1,416 @@
+package app
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+)
+
+const (
+	MaxPublicRoomsLimit = 500
+)
+
+type PublicRoomsQuery struct {
+	Limit    int
+	Since    string
+	Type     string
+	RoomType string
+	Bridge   *bool
+	JoinRule string
+	Search   string
+	Sort     string
+	Desc     bool
+
+	// m.room.create types to match, where "" matches rooms without a type
+	CreateTypes []string
+}
+
+type PublicRoomsPage struct {
+	Rooms     []PublicRoom
+	Total     int
+	NextBatch string
+	PrevBatch string
+}
+
+// ParsePublicRoomsQuery reads the pagination, filter and sort options for
+// /publicRooms from the request's query string.
+func ParsePublicRoomsQuery(v url.Values) (*PublicRoomsQuery, error) {
+	q := &PublicRoomsQuery{
+		Since:    v.Get("since"),
+		Type:     v.Get("type"),
+		RoomType: v.Get("room_type"),
+		JoinRule: v.Get("join_rule"),
+		Search:   strings.TrimSpace(v.Get("q")),
+		Sort:     v.Get("sort"),
+		Desc:     true,
+	}
+
+	if limit := v.Get("limit"); limit != "" {
+		l, err := strconv.Atoi(limit)
+		if err != nil || l < 1 {
+			return nil, errors.New("limit must be a positive integer")
+		}
+		if l > MaxPublicRoomsLimit {
+			l = MaxPublicRoomsLimit
+		}
+		q.Limit = l
+	}
+
+	switch q.Type {
+	case "", "space", "room":
+	default:
+		return nil, errors.New("type must be one of: space, room")
+	}
+
+	if bridge := v.Get("bridge"); bridge != "" {
+		b, err := strconv.ParseBool(bridge)
+		if err != nil {
+			return nil, errors.New("bridge must be true or false")
+		}
+		q.Bridge = &b
+	}
+
+	switch q.Sort {
+	case "", "members", "created", "activity":
+	default:
+		return nil, errors.New("sort must be one of: members, created, activity")
+	}
+
+	switch v.Get("dir") {
+	case "", "desc":
+	case "asc":
+		q.Desc = false
+	default:
+		return nil, errors.New("dir must be asc or desc")
+	}
+
+	return q, nil
+}
+
+// Matches reports whether a room passes the query's filters and search term.
+func (q *PublicRoomsQuery) Matches(room *PublicRoom) bool {
+
+	switch q.Type {
+	case "space":
+		if room.Type != "m.space" {
+			return false
+		}
+	case "room":
+		if room.Type == "m.space" {
+			return false
+		}
+	}
+
+	if len(q.CreateTypes) > 0 && !Contains(q.CreateTypes, room.Type) {
+		return false
+	}
+
+	if q.RoomType != "" && room.RoomType != q.RoomType {
+		return false
+	}
+
+	if q.Bridge != nil && room.IsBridge != *q.Bridge {
+		return false
+	}
+
+	if q.JoinRule != "" && room.JoinRule != q.JoinRule {
+		return false
+	}
+
+	if q.Search != "" {
+		term := strings.ToLower(q.Search)
+		fields := []string{
+			room.Name,
+			room.Topic,
+			room.CanonicalAlias,
+			room.CommuneAlias,
+		}
+		found := false
+		for _, f := range fields {
+			if strings.Contains(strings.ToLower(f), term) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// QueryPublicRooms filters, sorts and paginates a list of public rooms. The
+// batch tokens it returns are only meaningful to the same query.
+func QueryPublicRooms(rooms []PublicRoom, q *PublicRoomsQuery) (*PublicRoomsPage, error) {
+
+	offset, err := DecodeBatchToken(q.Since)
+	if err != nil {
+		return nil, err
+	}
+
+	matched := []PublicRoom{}
+	for i := range rooms {
+		if q.Matches(&rooms[i]) {
+			matched = append(matched, rooms[i])
+		}
+	}
+
+	if q.Sort != "" {
+		key := func(r *PublicRoom) int64 {
+			switch q.Sort {
+			case "members":
+				return int64(r.NumJoinedMembers)
+			case "created":
+				return r.OriginServerTS
+			default:
+				return r.LastActivityTS
+			}
+		}
+
+		sort.SliceStable(matched, func(i, j int) bool {
+			a, b := key(&matched[i]), key(&matched[j])
+			if a == b {
+				return matched[i].RoomID < matched[j].RoomID
+			}
+			if q.Desc {
+				return a > b
+			}
+			return a < b
+		})
+	}
+
+	page := &PublicRoomsPage{
+		Rooms: []PublicRoom{},
+		Total: len(matched),
+	}
+
+	if offset >= len(matched) {
+		if offset > 0 {
+			page.PrevBatch = EncodeBatchToken(max(len(matched)-max(q.Limit, 1), 0))
+		}
+		return page, nil
+	}
+
+	end := len(matched)
+	if q.Limit > 0 && offset+q.Limit < end {
+		end = offset + q.Limit
+		page.NextBatch = EncodeBatchToken(end)
+	}
+
+	if offset > 0 {
+		prev := 0
+		if q.Limit > 0 {
+			prev = max(offset-q.Limit, 0)
+		}
+		page.PrevBatch = EncodeBatchToken(prev)
+	}
+
+	page.Rooms = matched[offset:end]
+
+	return page, nil
+}
+
+// Batch tokens are opaque to clients, so we're free to change what they
+// encode later on.
+func EncodeBatchToken(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("o" + strconv.Itoa(offset)))
+}
+
+func DecodeBatchToken(token string) (int, error) {
+	if token == "" {
+		return 0, nil
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(b) < 2 || b[0] != 'o' {
+		return 0, errors.New("invalid pagination token")
+	}
+
+	offset, err := strconv.Atoi(string(b[1:]))
+	if err != nil || offset < 0 {
+		return 0, errors.New("invalid pagination token")
+	}
+
+	return offset, nil
+}
+
+// JoinedMemberCount counts the m.room.member events with a join membership.
+func JoinedMemberCount(state mautrix.RoomStateMap) int {
+	count := 0
+	for _, ev := range state[event.StateMember] {
+		if ev == nil {
+			continue
+		}
+		if membership, ok := ev.Content.Raw["membership"].(string); ok && membership == "join" {
+			count++
+		}
+	}
+	return count
+}
+
+// LatestStateTimestamp returns the timestamp of the most recent state event,
+// which serves as a rough indicator of when a room was last active.
+func LatestStateTimestamp(state mautrix.RoomStateMap) int64 {
+	var latest int64
+	for _, events := range state {
+		for _, ev := range events {
+			if ev != nil && ev.Timestamp > latest {
+				latest = ev.Timestamp
+			}
+		}
+	}
+	return latest
+}
+
+// SpecPublicRoom is a room in the shape of the client-server API's
+// /publicRooms chunk.
+type SpecPublicRoom struct {
+	RoomID           string `json:"room_id"`
+	Name             string `json:"name,omitempty"`
+	Topic            string `json:"topic,omitempty"`
+	CanonicalAlias   string `json:"canonical_alias,omitempty"`
+	AvatarURL        string `json:"avatar_url,omitempty"`
+	NumJoinedMembers int    `json:"num_joined_members"`
+	WorldReadable    bool   `json:"world_readable"`
+	GuestCanJoin     bool   `json:"guest_can_join"`
+	JoinRule         string `json:"join_rule,omitempty"`
+	RoomType         string `json:"room_type,omitempty"`
+}
+
+func NewSpecPublicRoom(r *PublicRoom) SpecPublicRoom {
+	return SpecPublicRoom{
+		RoomID:           r.RoomID,
+		Name:             r.Name,
+		Topic:            r.Topic,
+		CanonicalAlias:   r.CanonicalAlias,
+		AvatarURL:        r.AvatarURL,
+		NumJoinedMembers: r.NumJoinedMembers,
+		WorldReadable:    r.HistoryVisibility == "world_readable",
+		GuestCanJoin:     r.GuestCanJoin,
+		JoinRule:         r.JoinRule,
+		RoomType:         r.Type,
+	}
+}
+
+type SpecPublicRoomsRequest struct {
+	Limit  int    `json:"limit"`
+	Since  string `json:"since"`
+	Filter struct {
+		GenericSearchTerm string    `json:"generic_search_term"`
+		RoomTypes         []*string `json:"room_types"`
+	} `json:"filter"`
+}
+
+// SpecPublicRooms serves GET and POST /_matrix/client/v3/publicRooms for
+// generic Matrix clients, backed by the same data as /publicRooms.
+func (c *App) SpecPublicRooms() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		query := &PublicRoomsQuery{
+			Since: r.URL.Query().Get("since"),
+		}
+
+		limit := r.URL.Query().Get("limit")
+
+		if r.Method == http.MethodPost {
+			req, err := ReadRequestJSON(r, w, &SpecPublicRoomsRequest{})
+			if err != nil {
+				RespondWithError(w, &JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: map[string]any{
+						"errcode": "M_BAD_JSON",
+						"error":   "Content not JSON.",
+					},
+				})
+				return
+			}
+
+			query.Since = req.Since
+			query.Search = strings.TrimSpace(req.Filter.GenericSearchTerm)
+
+			// a null room type stands for rooms without a type
+			for _, t := range req.Filter.RoomTypes {
+				if t == nil {
+					query.CreateTypes = append(query.CreateTypes, "")
+					continue
+				}
+				query.CreateTypes = append(query.CreateTypes, *t)
+			}
+
+			limit = ""
+			if req.Limit > 0 {
+				limit = strconv.Itoa(req.Limit)
+			}
+		}
+
+		if limit != "" {
+			l, err := strconv.Atoi(limit)
+			if err != nil || l < 1 {
+				RespondWithError(w, &JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: map[string]any{
+						"errcode": "M_INVALID_PARAM",
+						"error":   "limit must be a positive integer",
+					},
+				})
+				return
+			}
+			query.Limit = min(l, MaxPublicRoomsLimit)
+		}
+
+		public_rooms, err := c.ListPublicRooms()
+		if err != nil {
+			RespondWithError(w, &JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: map[string]any{
+					"errcode": "M_UNKNOWN",
+					"error":   "Error fetching public rooms",
+				},
+			})
+			return
+		}
+
+		page, err := QueryPublicRooms(public_rooms, query)
+		if err != nil {
+			RespondWithError(w, &JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: map[string]any{
+					"errcode": "M_INVALID_PARAM",
+					"error":   err.Error(),
+				},
+			})
+			return
+		}
+
+		chunk := make([]SpecPublicRoom, 0, len(page.Rooms))
+		for i := range page.Rooms {
+			chunk = append(chunk, NewSpecPublicRoom(&page.Rooms[i]))
+		}
+
+		resp := map[string]any{
+			"chunk":                     chunk,
+			"total_room_count_estimate": page.Total,
+		}
+
+		if page.NextBatch != "" {
+			resp["next_batch"] = page.NextBatch
+		}
+
+		if page.PrevBatch != "" {
+			resp["prev_batch"] = page.PrevBatch
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: resp,
+		})
+	}
+}
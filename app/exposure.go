@@ -0,0 +1,333 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ErrRoomNotJoined means the appservice can't read the room at all.
+var ErrRoomNotJoined = errors.New("room not joined")
+
+type ExposurePolicy struct {
+	RequireWorldReadable  bool
+	RequirePublicJoinRule bool
+}
+
+func (c *App) ExposurePolicy() *ExposurePolicy {
+	p := &ExposurePolicy{
+		RequireWorldReadable:  true,
+		RequirePublicJoinRule: c.Config.Exposure.RequirePublicJoinRule,
+	}
+	if c.Config.Exposure.RequireWorldReadable != nil {
+		p.RequireWorldReadable = *c.Config.Exposure.RequireWorldReadable
+	}
+	return p
+}
+
+// Evaluate returns nil if a room with the given history visibility and join
+// rule may be exposed, or an error describing why it may not.
+func (p *ExposurePolicy) Evaluate(history_visibility, join_rule string) error {
+
+	// rooms without the event fall back to the spec defaults
+	if history_visibility == "" {
+		history_visibility = "shared"
+	}
+	if join_rule == "" {
+		join_rule = "invite"
+	}
+
+	if p.RequireWorldReadable && history_visibility != "world_readable" {
+		return fmt.Errorf("history visibility is %s, not world_readable", history_visibility)
+	}
+
+	if p.RequirePublicJoinRule && join_rule != "public" {
+		return fmt.Errorf("join rule is %s, not public", join_rule)
+	}
+
+	return nil
+}
+
+// EvaluateState applies the policy to a room's state, including whether room
+// moderators have opted the room out.
+func (p *ExposurePolicy) EvaluateState(state mautrix.RoomStateMap) error {
+	if OptedOut(state) {
+		return errors.New("room moderators have opted out of public access")
+	}
+	return p.Evaluate(StateString(state, event.StateHistoryVisibility, "history_visibility"),
+		StateString(state, event.StateJoinRules, "join_rule"))
+}
+
+// StateString reads a string field from the content of a state event with an
+// empty state key.
+func StateString(state mautrix.RoomStateMap, evt event.Type, field string) string {
+	ev := state[evt][""]
+	if ev == nil {
+		return ""
+	}
+	value, _ := ev.Content.Raw[field].(string)
+	return value
+}
+
+// EligibleRooms filters out rooms that the exposure policy doesn't allow, or
+// that a policy list bans.
+func (c *App) EligibleRooms(rooms []*PublicRooms) []*PublicRooms {
+	policy := c.ExposurePolicy()
+
+	eligible := []*PublicRooms{}
+	for _, room := range rooms {
+		if err := policy.EvaluateState(room.State); err != nil {
+			continue
+		}
+		if c.Policy.BannedRoom(room.RoomID.String()) != nil {
+			continue
+		}
+		eligible = append(eligible, room)
+	}
+
+	return eligible
+}
+
+func exposureKey(room_id string) string {
+	return fmt.Sprintf("exposure:%s", room_id)
+}
+
+// rooms the appservice can't read are remembered briefly, since events from
+// them arrive in every transaction
+const notJoinedTTL = time.Minute
+
+// ExposureRecord is the cached outcome of evaluating a room's exposure.
+type ExposureRecord struct {
+	// why the room isn't exposed, empty if it is
+	Reason    string           `json:"reason,omitempty"`
+	NotJoined bool             `json:"not_joined,omitempty"`
+	Endpoints EndpointExposure `json:"endpoints"`
+}
+
+func (c *App) exposureRecord(room_id id.RoomID) (*ExposureRecord, error) {
+	cached, err := c.Cache.Rooms.Get(context.Background(), exposureKey(room_id.String())).Result()
+	if err == nil {
+		var record ExposureRecord
+		if err := json.Unmarshal([]byte(cached), &record); err == nil {
+			if record.NotJoined {
+				return nil, ErrRoomNotJoined
+			}
+			return &record, nil
+		}
+	}
+
+	if err != nil && err != redis.Nil {
+		c.Log.Error().Msgf("Error reading room exposure: %v", err)
+	}
+
+	return c.refreshExposureRecord(room_id)
+}
+
+// RoomExposure decides whether a room may be exposed. It returns
+// ErrRoomNotJoined if the appservice can't read the room, and a policy error
+// if the room is joined but not eligible.
+func (c *App) RoomExposure(room_id id.RoomID) error {
+	if rule := c.Policy.BannedRoom(room_id.String()); rule != nil {
+		return fmt.Errorf("room is banned by a policy list: %s", rule.Entity)
+	}
+
+	if c.IsHidden(HiddenRooms, room_id.String()) {
+		return errors.New("room is hidden by local moderation")
+	}
+
+	record, err := c.exposureRecord(room_id)
+	if err != nil {
+		return err
+	}
+	if record.Reason != "" {
+		return errors.New(record.Reason)
+	}
+	return nil
+}
+
+// RoomEndpoints returns which groups of endpoints room moderators have chosen
+// to expose.
+func (c *App) RoomEndpoints(room_id id.RoomID) (*EndpointExposure, error) {
+	record, err := c.exposureRecord(room_id)
+	if err != nil {
+		return nil, err
+	}
+	return &record.Endpoints, nil
+}
+
+// RefreshRoomExposure evaluates the exposure policy against the room's
+// current state and caches the outcome.
+func (c *App) RefreshRoomExposure(room_id id.RoomID) error {
+	record, err := c.refreshExposureRecord(room_id)
+	if err != nil {
+		return err
+	}
+	if record.Reason != "" {
+		return errors.New(record.Reason)
+	}
+	return nil
+}
+
+func (c *App) refreshExposureRecord(room_id id.RoomID) (*ExposureRecord, error) {
+	ctx := context.Background()
+
+	state, err := c.Matrix.State(ctx, room_id)
+	if err != nil || state == nil {
+		b, _ := json.Marshal(&ExposureRecord{NotJoined: true})
+		err := c.Cache.Rooms.Set(ctx, exposureKey(room_id.String()), b, notJoinedTTL).Err()
+		if err != nil {
+			c.Log.Error().Msgf("Couldn't cache room exposure %v", err)
+		}
+		return nil, ErrRoomNotJoined
+	}
+
+	record := &ExposureRecord{
+		Endpoints: ReadEndpointExposure(state),
+	}
+
+	if err := c.ExposurePolicy().EvaluateState(state); err != nil {
+		record.Reason = err.Error()
+	}
+
+	ttl := c.Config.Cache.RoomState.ExpireAfter
+	if ttl == 0 {
+		ttl = 3600
+	}
+
+	b, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.Cache.Rooms.Set(ctx, exposureKey(room_id.String()), b, time.Duration(ttl)*time.Second).Err()
+	if err != nil {
+		c.Log.Error().Msgf("Couldn't cache room exposure %v", err)
+	}
+
+	return record, nil
+}
+
+func (c *App) InvalidateRoomExposure(room_id id.RoomID) error {
+	return c.Cache.Rooms.Del(context.Background(), exposureKey(room_id.String())).Err()
+}
+
+// rooms being re-evaluated in the background, and whether another change
+// arrived in the meantime, so that each room has one evaluation at a time
+var (
+	exposureChecksMu sync.Mutex
+	exposureChecks   = map[id.RoomID]bool{}
+)
+
+// RoomExposureChanged re-evaluates a room after a state event that the
+// exposure policy depends on. The stale record is dropped straight away, but
+// the evaluation waits on the homeserver, so it runs in the background where
+// it can't hold up the transaction that triggered it.
+func (c *App) RoomExposureChanged(room_id id.RoomID) {
+	if err := c.InvalidateRoomExposure(room_id); err != nil {
+		c.Log.Error().Msgf("Couldn't invalidate room exposure %v", err)
+	}
+
+	exposureChecksMu.Lock()
+	defer exposureChecksMu.Unlock()
+
+	if _, running := exposureChecks[room_id]; running {
+		exposureChecks[room_id] = true
+		return
+	}
+	exposureChecks[room_id] = false
+
+	go func() {
+		for {
+			c.checkRoomExposure(room_id)
+
+			exposureChecksMu.Lock()
+			again := exposureChecks[room_id]
+			if again {
+				exposureChecks[room_id] = false
+			} else {
+				delete(exposureChecks, room_id)
+			}
+			exposureChecksMu.Unlock()
+
+			if !again {
+				return
+			}
+		}
+	}()
+}
+
+// checkRoomExposure applies the exposure policy to a room, and rebuilds the
+// public rooms listing.
+func (c *App) checkRoomExposure(room_id id.RoomID) {
+	err := c.RefreshRoomExposure(room_id)
+	if err == ErrRoomNotJoined {
+		return
+	}
+
+	if err != nil {
+		c.Log.Info().Msgf("Room %v is no longer exposed: %v", room_id, err)
+		c.RoomBecameIneligible(room_id)
+	} else {
+		c.Log.Info().Msgf("Room %v is exposed", room_id)
+	}
+
+	go c.RebuildPublicRoomsCache()
+}
+
+// ClearPublicFlag withdraws the commune.room.public event the appservice sent
+// when it joined. An opt-out by room moderators is left alone, and nothing is
+// sent if the flag is already cleared.
+func (c *App) ClearPublicFlag(room_id id.RoomID) {
+	var public map[string]any
+	err := c.Matrix.StateEvent(context.Background(), room_id, RoomPublicEvent, "", &public)
+	if err != nil {
+		return
+	}
+
+	if v, ok := public["public"].(bool); !ok || !v {
+		return
+	}
+
+	_, err = c.Matrix.SendStateEvent(context.Background(), room_id, RoomPublicEvent, "", map[string]any{})
+	if err != nil {
+		c.Log.Error().Msgf("Error clearing public state event: %v", err)
+	}
+}
+
+// RoomBecameIneligible applies the configured policy to a joined room that no
+// longer qualifies for exposure. Whether the room is hidden or left, nothing
+// about it is served from the caches or broadcast anymore.
+func (c *App) RoomBecameIneligible(room_id id.RoomID) {
+
+	action := c.Config.Exposure.WhenIneligible
+
+	if action != "hide" && action != "leave" {
+		return
+	}
+
+	c.Log.Info().Msgf("Room %v is no longer eligible, action: %v", room_id, action)
+
+	c.ClearPublicFlag(room_id)
+
+	err := c.PurgeRoom(room_id)
+	if err != nil {
+		c.Log.Error().Msgf("Error purging room: %v", err)
+	}
+
+	UnsubscribeRoom(room_id.String())
+
+	if action == "leave" {
+		err = c.LeaveRoom(room_id)
+		if err != nil {
+			c.Log.Error().Msgf("Error leaving room: %v", err)
+		}
+	}
+}
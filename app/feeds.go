@@ -0,0 +1,606 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// feed formats, by the extension they're served with
+var feedTypes = map[string]string{
+	"atom": "application/atom+xml; charset=utf-8",
+	"rss":  "application/rss+xml; charset=utf-8",
+	"json": "application/feed+json; charset=utf-8",
+}
+
+// the most child rooms a space's feed is merged from
+const maxFeedRooms = 20
+
+// Feed is a room's, thread's or space's latest messages, newest first.
+type Feed struct {
+	Title       string
+	Description string
+	Link        string
+	Self        string
+	Updated     time.Time
+	Items       []*FeedItem
+}
+
+type FeedItem struct {
+	ID        string
+	URL       string
+	Title     string
+	Author    string
+	Room      string
+	Published time.Time
+	HTML      string
+	Text      string
+}
+
+// MatrixURI is the matrix: URI of an event, which never changes, unlike the
+// URLs of its pages.
+func MatrixURI(room_id, event_id string) string {
+	return fmt.Sprintf("matrix:roomid/%s/e/%s",
+		url.PathEscape(strings.TrimPrefix(room_id, "!")),
+		url.PathEscape(strings.TrimPrefix(event_id, "$")))
+}
+
+// FeedPath returns the path of a page's feed in the given format.
+func FeedPath(page_path, format string) string {
+	return page_path + "/feed." + format
+}
+
+func ThreadFeedPath(room_id, event_id, format string) string {
+	return FeedPath(RoomPagePath(room_id)+"/thread/"+pathSegment(event_id), format)
+}
+
+// NewFeedItem turns a page event into a feed entry. Media are linked, and
+// images shown, from the media proxy.
+func (c *App) NewFeedItem(room_id string, ev *PageEvent) *FeedItem {
+	item := &FeedItem{
+		ID:        MatrixURI(room_id, ev.EventID),
+		URL:       c.PublicURL() + ev.Path,
+		Author:    ev.Author(),
+		Published: ev.Time,
+		Text:      ev.Text,
+	}
+
+	switch ev.Kind {
+	case "text", "notice", "emote":
+		item.HTML = string(ev.Body)
+	case "image":
+		item.HTML = fmt.Sprintf(`<p><img src="%s" alt="%s"></p>`,
+			html.EscapeString(c.ThumbnailURL(ev.URL, 800, 800)), html.EscapeString(ev.Text))
+	default:
+		item.Text = ev.Filename
+		item.HTML = fmt.Sprintf(`<p><a href="%s">%s</a></p>`,
+			html.EscapeString(c.MediaURL(ev.URL)), html.EscapeString(ev.Filename))
+	}
+
+	item.Title = Truncate(item.Text, 80)
+	if item.Title == "" {
+		item.Title = "Message from " + item.Author
+	}
+
+	return item
+}
+
+// feedItems turns filtered timeline events into feed entries, leaving out
+// gaps and events pages don't show.
+func (c *App) feedItems(room_id string, events []map[string]any) []*FeedItem {
+	items := []*FeedItem{}
+	for _, ev := range events {
+		pe := c.NewPageEvent(room_id, ev)
+		if pe == nil || pe.Kind == "gap" {
+			continue
+		}
+		items = append(items, c.NewFeedItem(room_id, pe))
+	}
+	return items
+}
+
+// ThreadTimeline reads the latest replies in a thread, newest first, and
+// filters them like the /relations proxy does.
+func (c *App) ThreadTimeline(room_id id.RoomID, root string) ([]map[string]any, error) {
+	body, err := c.Matrix.MakeFullRequest(context.Background(), mautrix.FullRequest{
+		Method: http.MethodGet,
+		URL: c.Matrix.BuildURLWithQuery(mautrix.ClientURLPath{"v1", "rooms", room_id, "relations", root, "m.thread"}, map[string]string{
+			"dir":   "b",
+			"limit": strconv.Itoa(c.PageTimelineLimit()),
+		}),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	filtered, _, err := c.FilterTimelineResponse(room_id, body)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Chunk []map[string]any `json:"chunk"`
+	}
+	if err := DecodeJSON(filtered, &resp); err != nil {
+		return nil, err
+	}
+
+	sanitizer := c.Sanitizer()
+
+	events := make([]map[string]any, 0, len(resp.Chunk))
+	for _, ev := range resp.Chunk {
+		if sanitizer.SanitizeEvent(ev) {
+			events = append(events, ev)
+		}
+	}
+
+	return events, nil
+}
+
+// messagesExposed reports whether a room's messages may be syndicated.
+func (c *App) messagesExposed(room_id id.RoomID, endpoint string) bool {
+	endpoints, err := c.RoomEndpoints(room_id)
+	return err == nil && endpoints.Allows("messages") && !c.EndpointDisabled(room_id, endpoint)
+}
+
+func (f *Feed) atom() ([]byte, error) {
+	type link struct {
+		Rel  string `xml:"rel,attr,omitempty"`
+		Type string `xml:"type,attr,omitempty"`
+		Href string `xml:"href,attr"`
+	}
+	type text struct {
+		Type string `xml:"type,attr,omitempty"`
+		Body string `xml:",chardata"`
+	}
+	type category struct {
+		Term string `xml:"term,attr"`
+	}
+	type entry struct {
+		ID        string     `xml:"id"`
+		Title     string     `xml:"title"`
+		Link      link       `xml:"link"`
+		Author    string     `xml:"author>name"`
+		Published string     `xml:"published"`
+		Updated   string     `xml:"updated"`
+		Category  []category `xml:"category"`
+		Summary   text       `xml:"summary"`
+		Content   text       `xml:"content"`
+	}
+	type feed struct {
+		XMLName  xml.Name `xml:"feed"`
+		XMLNS    string   `xml:"xmlns,attr"`
+		ID       string   `xml:"id"`
+		Title    string   `xml:"title"`
+		Subtitle string   `xml:"subtitle,omitempty"`
+		Updated  string   `xml:"updated"`
+		Links    []link   `xml:"link"`
+		Entries  []entry  `xml:"entry"`
+	}
+
+	out := feed{
+		XMLNS:    "http://www.w3.org/2005/Atom",
+		ID:       f.Self,
+		Title:    f.Title,
+		Subtitle: f.Description,
+		Updated:  f.Updated.Format(time.RFC3339),
+		Links: []link{
+			{Rel: "self", Type: "application/atom+xml", Href: f.Self},
+			{Rel: "alternate", Type: "text/html", Href: f.Link},
+		},
+	}
+
+	for _, item := range f.Items {
+		e := entry{
+			ID:        item.ID,
+			Title:     item.Title,
+			Link:      link{Rel: "alternate", Type: "text/html", Href: item.URL},
+			Author:    item.Author,
+			Published: item.Published.Format(time.RFC3339),
+			Updated:   item.Published.Format(time.RFC3339),
+			Summary:   text{Type: "text", Body: item.Text},
+			Content:   text{Type: "html", Body: item.HTML},
+		}
+		if item.Room != "" {
+			e.Category = []category{{Term: item.Room}}
+		}
+		out.Entries = append(out.Entries, e)
+	}
+
+	b, err := xml.Marshal(out)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
+
+func (f *Feed) rss() ([]byte, error) {
+	type guid struct {
+		IsPermaLink string `xml:"isPermaLink,attr"`
+		Value       string `xml:",chardata"`
+	}
+	type atomLink struct {
+		Href string `xml:"href,attr"`
+		Rel  string `xml:"rel,attr"`
+		Type string `xml:"type,attr"`
+	}
+	type item struct {
+		Title       string   `xml:"title"`
+		Link        string   `xml:"link"`
+		GUID        guid     `xml:"guid"`
+		PubDate     string   `xml:"pubDate"`
+		Creator     string   `xml:"dc:creator,omitempty"`
+		Category    []string `xml:"category"`
+		Description string   `xml:"description"`
+	}
+	type channel struct {
+		Title         string   `xml:"title"`
+		Link          string   `xml:"link"`
+		Description   string   `xml:"description"`
+		LastBuildDate string   `xml:"lastBuildDate"`
+		Self          atomLink `xml:"atom:link"`
+		Items         []item   `xml:"item"`
+	}
+	type rss struct {
+		XMLName xml.Name `xml:"rss"`
+		Version string   `xml:"version,attr"`
+		Atom    string   `xml:"xmlns:atom,attr"`
+		DC      string   `xml:"xmlns:dc,attr"`
+		Channel channel  `xml:"channel"`
+	}
+
+	out := rss{
+		Version: "2.0",
+		Atom:    "http://www.w3.org/2005/Atom",
+		DC:      "http://purl.org/dc/elements/1.1/",
+		Channel: channel{
+			Title:         f.Title,
+			Link:          f.Link,
+			Description:   f.Description,
+			LastBuildDate: f.Updated.Format(time.RFC1123Z),
+			Self:          atomLink{Href: f.Self, Rel: "self", Type: "application/rss+xml"},
+		},
+	}
+	if out.Channel.Description == "" {
+		out.Channel.Description = f.Title
+	}
+
+	for _, it := range f.Items {
+		i := item{
+			Title:       it.Title,
+			Link:        it.URL,
+			GUID:        guid{IsPermaLink: "false", Value: it.ID},
+			PubDate:     it.Published.Format(time.RFC1123Z),
+			Creator:     it.Author,
+			Description: it.HTML,
+		}
+		if it.Room != "" {
+			i.Category = []string{it.Room}
+		}
+		out.Channel.Items = append(out.Channel.Items, i)
+	}
+
+	b, err := xml.Marshal(out)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
+
+func (f *Feed) jsonFeed() ([]byte, error) {
+	type author struct {
+		Name string `json:"name"`
+	}
+	type item struct {
+		ID            string   `json:"id"`
+		URL           string   `json:"url"`
+		Title         string   `json:"title"`
+		ContentHTML   string   `json:"content_html"`
+		ContentText   string   `json:"content_text,omitempty"`
+		DatePublished string   `json:"date_published"`
+		Authors       []author `json:"authors,omitempty"`
+		Tags          []string `json:"tags,omitempty"`
+	}
+	type feed struct {
+		Version     string `json:"version"`
+		Title       string `json:"title"`
+		HomePageURL string `json:"home_page_url"`
+		FeedURL     string `json:"feed_url"`
+		Description string `json:"description,omitempty"`
+		Items       []item `json:"items"`
+	}
+
+	out := feed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       f.Title,
+		HomePageURL: f.Link,
+		FeedURL:     f.Self,
+		Description: f.Description,
+		Items:       []item{},
+	}
+
+	for _, it := range f.Items {
+		i := item{
+			ID:            it.ID,
+			URL:           it.URL,
+			Title:         it.Title,
+			ContentHTML:   it.HTML,
+			ContentText:   it.Text,
+			DatePublished: it.Published.Format(time.RFC3339),
+		}
+		if it.Author != "" {
+			i.Authors = []author{{Name: it.Author}}
+		}
+		if it.Room != "" {
+			i.Tags = []string{it.Room}
+		}
+		out.Items = append(out.Items, i)
+	}
+
+	return json.Marshal(out)
+}
+
+// Render encodes a feed in the given format.
+func (f *Feed) Render(format string) ([]byte, error) {
+	for _, item := range f.Items {
+		if item.Published.After(f.Updated) {
+			f.Updated = item.Published
+		}
+	}
+
+	switch format {
+	case "atom":
+		return f.atom()
+	case "rss":
+		return f.rss()
+	default:
+		return f.jsonFeed()
+	}
+}
+
+// feedFormat reads the requested format, rendering a 404 for unknown ones.
+func (c *App) feedFormat(w http.ResponseWriter, r *http.Request) (string, bool) {
+	format := chi.URLParam(r, "format")
+	if _, ok := feedTypes[format]; !ok {
+		c.RenderErrorPage(w, http.StatusNotFound, "Page not found")
+		return "", false
+	}
+	return format, true
+}
+
+// ServeFeed renders a feed, answering conditional requests from its ETag,
+// a hash of its content, and the time of its newest item.
+func (c *App) ServeFeed(w http.ResponseWriter, r *http.Request, feed *Feed, format string) {
+	b, err := feed.Render(format)
+	if err != nil {
+		c.Log.Error().Msgf("Error rendering feed: %v", err)
+		c.RenderErrorPage(w, http.StatusInternalServerError, "Couldn't render this feed")
+		return
+	}
+
+	sum := sha256.Sum256(b)
+
+	w.Header().Set("Content-Type", feedTypes[format])
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	http.ServeContent(w, r, "", feed.Updated, bytes.NewReader(b))
+}
+
+// RoomFeed syndicates a room's latest messages.
+func (c *App) RoomFeed() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		format, ok := c.feedFormat(w, r)
+		if !ok {
+			return
+		}
+
+		room_id, ok := c.pageRoom(w, r)
+		if !ok {
+			return
+		}
+
+		resolved, ok := c.resolvePage(w, &RoomInfoOptions{
+			RoomID: room_id.String(),
+		})
+		if !ok {
+			return
+		}
+
+		page, entry := c.NewPage(resolved)
+
+		if entry != nil && entry.Type == "m.space" {
+			http.Redirect(w, r, FeedPath(SpacePagePath(room_id.String()), format), http.StatusMovedPermanently)
+			return
+		}
+
+		if !c.messagesExposed(room_id, "messages") {
+			c.RenderErrorPage(w, http.StatusNotFound, "This room's messages aren't public")
+			return
+		}
+
+		events, _, err := c.RoomTimeline(room_id, "")
+		if err != nil {
+			c.Log.Error().Msgf("Error fetching room timeline: %v", err)
+			c.RenderErrorPage(w, http.StatusBadGateway, "Couldn't load this room's messages")
+			return
+		}
+
+		c.ServeFeed(w, r, &Feed{
+			Title:       page.Name,
+			Description: page.Description,
+			Link:        c.PublicURL() + RoomPagePath(room_id.String()),
+			Self:        c.PublicURL() + FeedPath(RoomPagePath(room_id.String()), format),
+			Items:       c.feedItems(room_id.String(), events),
+		}, format)
+	}
+}
+
+// ThreadFeed syndicates the latest replies in a thread, after its root.
+func (c *App) ThreadFeed() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		format, ok := c.feedFormat(w, r)
+		if !ok {
+			return
+		}
+
+		room_id, ok := c.pageRoom(w, r)
+		if !ok {
+			return
+		}
+
+		if !c.messagesExposed(room_id, "relations") {
+			c.RenderErrorPage(w, http.StatusNotFound, "Thread not found")
+			return
+		}
+
+		event_id, err := url.PathUnescape(chi.URLParam(r, "event_id"))
+		if err != nil {
+			c.RenderErrorPage(w, http.StatusNotFound, "Thread not found")
+			return
+		}
+
+		resolved, ok := c.resolvePage(w, &RoomInfoOptions{
+			RoomID:  room_id.String(),
+			EventID: event_id,
+		})
+		if !ok {
+			return
+		}
+
+		var root *PageEvent
+		if resolved.Event != nil {
+			root = c.NewPageEvent(room_id.String(), resolved.Event)
+		}
+		if root == nil || root.Kind == "gap" {
+			c.RenderErrorPage(w, http.StatusNotFound, "Thread not found")
+			return
+		}
+		if resolved.Sender != nil {
+			root.SenderName = resolved.Sender.DisplayName
+		}
+
+		page, _ := c.NewPage(resolved)
+
+		replies, err := c.ThreadTimeline(room_id, event_id)
+		if err != nil {
+			c.Log.Error().Msgf("Error fetching thread: %v", err)
+			c.RenderErrorPage(w, http.StatusBadGateway, "Couldn't load this thread")
+			return
+		}
+
+		items := c.feedItems(room_id.String(), replies)
+		items = append(items, c.NewFeedItem(room_id.String(), root))
+
+		c.ServeFeed(w, r, &Feed{
+			Title:       fmt.Sprintf("%s in %s", Truncate(root.Text, 60), page.Name),
+			Description: root.Text,
+			Link:        c.PublicURL() + root.Path,
+			Self:        c.PublicURL() + ThreadFeedPath(room_id.String(), event_id, format),
+			Items:       items,
+		}, format)
+	}
+}
+
+// SpaceFeed merges the latest messages of a space's child rooms whose
+// messages are exposed.
+func (c *App) SpaceFeed() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		format, ok := c.feedFormat(w, r)
+		if !ok {
+			return
+		}
+
+		room_id, ok := c.pageRoom(w, r)
+		if !ok {
+			return
+		}
+
+		resolved, ok := c.resolvePage(w, &RoomInfoOptions{
+			RoomID: room_id.String(),
+		})
+		if !ok {
+			return
+		}
+
+		page, entry := c.NewPage(resolved)
+
+		if entry == nil || entry.Type != "m.space" {
+			http.Redirect(w, r, FeedPath(RoomPagePath(room_id.String()), format), http.StatusMovedPermanently)
+			return
+		}
+
+		children := []*PageRoom{}
+		for _, child := range page.Children {
+			if !child.Space && c.messagesExposed(id.RoomID(child.RoomID), "messages") {
+				children = append(children, child)
+			}
+		}
+		if len(children) > maxFeedRooms {
+			children = children[:maxFeedRooms]
+		}
+
+		timelines := make([][]*FeedItem, len(children))
+
+		var wg sync.WaitGroup
+		for i, child := range children {
+			wg.Add(1)
+			go func(i int, child *PageRoom) {
+				defer wg.Done()
+
+				events, _, err := c.RoomTimeline(id.RoomID(child.RoomID), "")
+				if err != nil {
+					c.Log.Error().Msgf("Error fetching room timeline for space feed: %v", err)
+					return
+				}
+
+				items := c.feedItems(child.RoomID, events)
+				for _, item := range items {
+					item.Room = child.Name
+				}
+				timelines[i] = items
+			}(i, child)
+		}
+		wg.Wait()
+
+		items := []*FeedItem{}
+		for _, timeline := range timelines {
+			items = append(items, timeline...)
+		}
+
+		sort.SliceStable(items, func(i, j int) bool {
+			return items[i].Published.After(items[j].Published)
+		})
+		if len(items) > c.PageTimelineLimit() {
+			items = items[:c.PageTimelineLimit()]
+		}
+
+		c.ServeFeed(w, r, &Feed{
+			Title:       page.Name,
+			Description: page.Description,
+			Link:        c.PublicURL() + SpacePagePath(room_id.String()),
+			Self:        c.PublicURL() + FeedPath(SpacePagePath(room_id.String()), format),
+			Items:       items,
+		}, format)
+	}
+}
@@ -0,0 +1,130 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+type StateFetchResult struct {
+	// rooms whose state was fetched, in the order they were requested
+	States []*PublicRooms
+	Failed map[id.RoomID]error
+}
+
+// PartialFetchError is returned alongside partial results when the state of
+// some, but not all, rooms could not be fetched.
+type PartialFetchError struct {
+	Failed map[id.RoomID]error
+	Total  int
+}
+
+func (e *PartialFetchError) Error() string {
+	return fmt.Sprintf("couldn't fetch state for %d of %d rooms", len(e.Failed), e.Total)
+}
+
+func (c *App) StateConcurrency() int {
+	if c.Config.Matrix.StateConcurrency > 0 {
+		return c.Config.Matrix.StateConcurrency
+	}
+	return 8
+}
+
+func (c *App) StateTimeout() time.Duration {
+	if c.Config.Matrix.StateTimeout > 0 {
+		return time.Duration(c.Config.Matrix.StateTimeout) * time.Second
+	}
+	return 30 * time.Second
+}
+
+// FetchRoomStates fetches the full state of each room using a bounded number
+// of concurrent requests, so that we don't overwhelm the homeserver. Rooms
+// that fail are reported in Failed and left out of States.
+func (c *App) FetchRoomStates(ctx context.Context, room_ids []id.RoomID) *StateFetchResult {
+
+	total := len(room_ids)
+
+	states := make([]*PublicRooms, total)
+	errs := make([]error, total)
+
+	// log progress roughly every 10%
+	step := max(total/10, 1)
+
+	var (
+		wg   sync.WaitGroup
+		lock sync.Mutex
+		done int
+	)
+
+	sem := make(chan struct{}, c.StateConcurrency())
+
+	for i, room_id := range room_ids {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(i int, room_id id.RoomID) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			rctx, cancel := context.WithTimeout(ctx, c.StateTimeout())
+			defer cancel()
+
+			state, err := c.Matrix.State(rctx, room_id)
+			if err == nil && state == nil {
+				err = fmt.Errorf("empty state")
+			}
+
+			if err != nil {
+				errs[i] = err
+			} else {
+				states[i] = &PublicRooms{
+					RoomID: room_id,
+					State:  state,
+				}
+			}
+
+			lock.Lock()
+			done++
+			if done%step == 0 || done == total {
+				c.Log.Info().Msgf("Fetched state for %d/%d rooms", done, total)
+			}
+			lock.Unlock()
+		}(i, room_id)
+	}
+
+	wg.Wait()
+
+	result := &StateFetchResult{
+		States: []*PublicRooms{},
+		Failed: map[id.RoomID]error{},
+	}
+
+	for i, room_id := range room_ids {
+		if errs[i] != nil {
+			result.Failed[room_id] = errs[i]
+			c.Log.Error().Msgf("Error fetching state for %v: %v", room_id, errs[i])
+			continue
+		}
+		result.States = append(result.States, states[i])
+	}
+
+	if len(result.Failed) > 0 {
+		c.Log.Warn().Msgf("Couldn't fetch state for %d of %d rooms", len(result.Failed), total)
+	}
+
+	return result
+}
+
+// Err summarizes failures, returning nil if every room was fetched.
+func (r *StateFetchResult) Err() error {
+	if len(r.Failed) == 0 {
+		return nil
+	}
+	return &PartialFetchError{
+		Failed: r.Failed,
+		Total:  len(r.Failed) + len(r.States),
+	}
+}
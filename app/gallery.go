@@ -0,0 +1,487 @@
+package app
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/redis/go-redis/v9"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// kinds of media event listed in room galleries, by msgtype, and m.sticker
+// for stickers
+var galleryKinds = []string{"m.image", "m.video", "m.file", "m.audio", "m.sticker"}
+
+const (
+	DefaultGalleryLimit = 20
+	MaxGalleryLimit     = 100
+
+	// how many times the index is read for one page, when it turns up
+	// mostly events that can't be shown
+	maxGalleryReads = 10
+)
+
+// each kind has its own sorted set of event IDs, scored by timestamp, so
+// that type filters don't have to scan the others
+func galleryKey(room_id string, kind string) string {
+	return fmt.Sprintf("gallery:%s:%s", room_id, kind)
+}
+
+// how long a backfill in progress keeps others from starting, in case it
+// never finishes
+const galleryBackfillTimeout = time.Hour
+
+func galleryBackfillKey(room_id string) string {
+	return fmt.Sprintf("gallery_backfill:%s", room_id)
+}
+
+// GalleryKind returns the gallery kind of a media event, or false if the
+// event doesn't belong in the gallery. Edits are left out, since the
+// original event is already listed.
+func GalleryKind(event_type string, content map[string]any) (string, bool) {
+	if event_type == "m.sticker" {
+		return "m.sticker", true
+	}
+	if event_type != "m.room.message" {
+		return "", false
+	}
+
+	if relates, ok := content["m.relates_to"].(map[string]any); ok {
+		if rel, _ := relates["rel_type"].(string); rel == "m.replace" {
+			return "", false
+		}
+	}
+
+	msgtype, _ := content["msgtype"].(string)
+	if !Contains(galleryKinds, msgtype) {
+		return "", false
+	}
+	return msgtype, true
+}
+
+// IndexGalleryEvent adds a media event to its room's gallery. The event
+// itself is read from the events cache when the gallery is listed.
+func (c *App) IndexGalleryEvent(ev *event.Event) error {
+	kind, ok := GalleryKind(ev.Type.Type, ev.Content.Raw)
+	if !ok || ev.RoomID == "" || ev.ID == "" {
+		return nil
+	}
+
+	return c.Cache.Rooms.ZAdd(context.Background(), galleryKey(ev.RoomID.String(), kind), redis.Z{
+		Score:  float64(ev.Timestamp),
+		Member: ev.ID.String(),
+	}).Err()
+}
+
+// RemoveGalleryEvent takes a redacted event out of its room's gallery.
+func (c *App) RemoveGalleryEvent(room_id id.RoomID, event_id id.EventID) error {
+	ctx := context.Background()
+
+	pipe := c.Cache.Rooms.Pipeline()
+	for _, kind := range galleryKinds {
+		pipe.ZRem(ctx, galleryKey(room_id.String(), kind), event_id.String())
+	}
+	_, err := pipe.Exec(ctx)
+
+	return err
+}
+
+// galleryKeys lists the keys PurgeRoom removes along with the room.
+func galleryKeys(room_id string) []string {
+	keys := []string{galleryBackfillKey(room_id)}
+	for _, kind := range galleryKinds {
+		keys = append(keys, galleryKey(room_id, kind))
+	}
+	return keys
+}
+
+// GalleryBackfillPages returns how many pages of 100 events are read from
+// room history when a gallery is first built.
+func (c *App) GalleryBackfillPages() int {
+	if c.Config.Gallery.BackfillPages > 0 {
+		return c.Config.Gallery.BackfillPages
+	}
+	return 50
+}
+
+// BackfillGallery indexes the media events in a room's history. It only
+// runs once per room, until the room is purged. A backfill that fails, or
+// never finishes, is tried again the next time.
+func (c *App) BackfillGallery(room_id id.RoomID) {
+	ctx := context.Background()
+	key := galleryBackfillKey(room_id.String())
+
+	started, err := c.Cache.Rooms.SetNX(ctx, key, "running", galleryBackfillTimeout).Result()
+	if err != nil {
+		c.Log.Error().Msgf("Couldn't start gallery backfill: %v", err)
+		return
+	}
+	if !started {
+		return
+	}
+
+	done := false
+	defer func() {
+		if done {
+			err = c.Cache.Rooms.Set(ctx, key, "done", 0).Err()
+		} else {
+			err = c.Cache.Rooms.Del(ctx, key).Err()
+		}
+		if err != nil {
+			c.Log.Error().Msgf("Couldn't record gallery backfill: %v", err)
+		}
+	}()
+
+	c.Log.Info().Msgf("Backfilling gallery for room: %v", room_id)
+
+	from := ""
+	for page := 0; page < c.GalleryBackfillPages(); page++ {
+		messages, err := c.Matrix.Messages(ctx, room_id, from, "", mautrix.DirectionBackward, nil, 100)
+		if err != nil {
+			c.Log.Error().Msgf("Error backfilling gallery: %v", err)
+			return
+		}
+
+		for _, ev := range messages.Chunk {
+			ev.RoomID = room_id
+
+			// the visibility timeline decides which of these may be shown
+			if ev.Type.Type == "m.room.history_visibility" && ev.StateKey != nil {
+				if visibility, ok := ev.Content.Raw["history_visibility"].(string); ok {
+					err := c.RecordVisibilityChange(room_id, ev.ID, ev.Timestamp, visibility)
+					if err != nil {
+						c.Log.Error().Msgf("Error recording history visibility: %v", err)
+					}
+				}
+			}
+
+			if _, ok := GalleryKind(ev.Type.Type, ev.Content.Raw); !ok {
+				continue
+			}
+
+			b, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			if err := c.CacheEvent(room_id, ev.ID, b); err != nil {
+				continue
+			}
+			if err := c.IndexGalleryEvent(ev); err != nil {
+				c.Log.Error().Msgf("Error indexing gallery event: %v", err)
+			}
+			c.IndexNewEventMedia(ev)
+		}
+
+		if messages.End == "" || len(messages.Chunk) == 0 {
+			break
+		}
+		from = messages.End
+	}
+
+	done = true
+}
+
+type GalleryQuery struct {
+	Kinds []string
+	Limit int
+	From  *GalleryPosition
+}
+
+// GalleryPosition is where a page of the gallery ends. Events with the same
+// timestamp are ordered by event ID, as Redis orders them.
+type GalleryPosition struct {
+	TS      int64
+	EventID string
+}
+
+// before reports whether an entry comes after the position, going back in
+// time.
+func (p *GalleryPosition) before(z redis.Z) bool {
+	member, _ := z.Member.(string)
+	ts := int64(z.Score)
+	return ts < p.TS || (ts == p.TS && member < p.EventID)
+}
+
+func EncodeGalleryToken(p *GalleryPosition) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("g%d:%s", p.TS, p.EventID)))
+}
+
+func DecodeGalleryToken(token string) (*GalleryPosition, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(b) < 2 || b[0] != 'g' {
+		return nil, errors.New("invalid pagination token")
+	}
+
+	ts, event_id, ok := strings.Cut(string(b[1:]), ":")
+	if !ok || event_id == "" {
+		return nil, errors.New("invalid pagination token")
+	}
+
+	n, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid pagination token")
+	}
+
+	return &GalleryPosition{TS: n, EventID: event_id}, nil
+}
+
+// ParseGalleryQuery reads the type filter and pagination options. Types may
+// be repeated or comma separated, and default to all kinds.
+func ParseGalleryQuery(v url.Values) (*GalleryQuery, error) {
+	q := &GalleryQuery{
+		Limit: DefaultGalleryLimit,
+	}
+
+	for _, types := range v["types"] {
+		for _, kind := range strings.Split(types, ",") {
+			kind = strings.TrimSpace(kind)
+			if kind == "" {
+				continue
+			}
+			if !Contains(galleryKinds, kind) {
+				return nil, fmt.Errorf("types must be any of: %s", strings.Join(galleryKinds, ", "))
+			}
+			if !Contains(q.Kinds, kind) {
+				q.Kinds = append(q.Kinds, kind)
+			}
+		}
+	}
+	if len(q.Kinds) == 0 {
+		q.Kinds = galleryKinds
+	}
+
+	if limit := v.Get("limit"); limit != "" {
+		l, err := strconv.Atoi(limit)
+		if err != nil || l < 1 {
+			return nil, errors.New("limit must be a positive integer")
+		}
+		q.Limit = min(l, MaxGalleryLimit)
+	}
+
+	if from := v.Get("from"); from != "" {
+		p, err := DecodeGalleryToken(from)
+		if err != nil {
+			return nil, err
+		}
+		q.From = p
+	}
+
+	return q, nil
+}
+
+// galleryPage reads up to count entries of one kind, newest first, that
+// come after the query's position.
+func (c *App) galleryPage(ctx context.Context, key string, from *GalleryPosition, count int) ([]redis.Z, error) {
+	max_score := "+inf"
+	if from != nil {
+		max_score = strconv.FormatInt(from.TS, 10)
+	}
+
+	entries := []redis.Z{}
+	offset := 0
+
+	for len(entries) < count {
+		zs, err := c.Cache.Rooms.ZRevRangeByScoreWithScores(ctx, key, &redis.ZRangeBy{
+			Min:    "-inf",
+			Max:    max_score,
+			Offset: int64(offset),
+			Count:  int64(count),
+		}).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, z := range zs {
+			// entries sharing the position's timestamp may already have
+			// been listed
+			if from != nil && !from.before(z) {
+				continue
+			}
+			entries = append(entries, z)
+		}
+
+		if len(zs) < count {
+			break
+		}
+		offset += len(zs)
+	}
+
+	if len(entries) > count {
+		entries = entries[:count]
+	}
+	return entries, nil
+}
+
+// galleryEntries merges up to count of the newest entries of each kind that
+// come after a position, and returns the newest count of them.
+func (c *App) galleryEntries(ctx context.Context, room_id id.RoomID, kinds []string, from *GalleryPosition, count int) ([]redis.Z, error) {
+	entries := []redis.Z{}
+	for _, kind := range kinds {
+		zs, err := c.galleryPage(ctx, galleryKey(room_id.String(), kind), from, count)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, zs...)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return galleryPosition(entries[i]).before(entries[j])
+	})
+
+	if len(entries) > count {
+		entries = entries[:count]
+	}
+	return entries, nil
+}
+
+func galleryPosition(z redis.Z) *GalleryPosition {
+	p := &GalleryPosition{TS: int64(z.Score)}
+	p.EventID, _ = z.Member.(string)
+	return p
+}
+
+// QueryGallery returns a page of a room's media events that may be shown,
+// newest first, along with the token for the next page. The index is read
+// until the page holds limit events that may be shown, and runs of hidden
+// events in between are replaced by gap markers. A room whose index is
+// mostly hidden events may still return fewer, with next_batch set to carry
+// on from where the reading stopped.
+func (c *App) QueryGallery(room_id id.RoomID, q *GalleryQuery) ([]map[string]any, string, error) {
+	ctx := context.Background()
+
+	f, err := c.NewEventFilter(room_id)
+	if err != nil {
+		return nil, "", err
+	}
+	sanitizer := c.Sanitizer()
+
+	events := []map[string]any{}
+	shown := 0
+	from := q.From
+	next_batch := ""
+
+	// one more than needed, to tell whether there's another page
+	count := q.Limit + 1
+
+	for read := 0; shown < q.Limit; read++ {
+		if read == maxGalleryReads {
+			next_batch = EncodeGalleryToken(from)
+			break
+		}
+
+		entries, err := c.galleryEntries(ctx, room_id, q.Kinds, from, count)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(entries) == 0 {
+			break
+		}
+
+		event_ids := make([]string, 0, len(entries))
+		for _, z := range entries {
+			event_id, _ := z.Member.(string)
+			event_ids = append(event_ids, event_id)
+		}
+
+		values, err := c.Cache.Events.MGet(ctx, event_ids...).Result()
+		if err != nil {
+			return nil, "", err
+		}
+
+		for i, value := range values {
+			if shown == q.Limit {
+				next_batch = EncodeGalleryToken(from)
+				break
+			}
+			from = galleryPosition(entries[i])
+
+			s, ok := value.(string)
+			if !ok {
+				continue
+			}
+
+			var ev map[string]any
+			if err := DecodeJSON([]byte(s), &ev); err != nil {
+				continue
+			}
+			if !sanitizer.SanitizeEvent(ev) {
+				continue
+			}
+
+			if f.Visible(ev) {
+				shown++
+			}
+			events = append(events, ev)
+		}
+
+		if len(entries) < count {
+			break
+		}
+		if shown == q.Limit && next_batch == "" {
+			next_batch = EncodeGalleryToken(from)
+		}
+	}
+
+	return FilterEvents(f, events), next_batch, nil
+}
+
+// RoomGallery lists the images, videos, files, audio and stickers posted in
+// a room, newest first.
+func (c *App) RoomGallery() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		room_id := id.RoomID(chi.URLParam(r, "room_id"))
+
+		q, err := ParseGalleryQuery(r.URL.Query())
+		if err != nil {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: map[string]any{
+					"errcode": "M_INVALID_PARAM",
+					"error":   err.Error(),
+				},
+			})
+			return
+		}
+
+		// the first request for a room's gallery starts its backfill
+		go c.BackfillGallery(room_id)
+
+		chunk, next_batch, err := c.QueryGallery(room_id, q)
+		if err != nil {
+			c.Log.Error().Msgf("Error querying gallery: %v", err)
+			RespondWithError(w, &JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: map[string]any{
+					"errcode": "M_UNKNOWN",
+					"error":   "Couldn't list the room's media.",
+				},
+			})
+			return
+		}
+
+		resp := map[string]any{
+			"chunk": chunk,
+		}
+		if next_batch != "" {
+			resp["next_batch"] = next_batch
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: resp,
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package app
+
+import (
+	"io"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// tags allowed in formatted message bodies, as suggested by the spec
+var allowedHTMLTags = []string{
+	"font", "del", "h1", "h2", "h3", "h4", "h5", "h6", "blockquote", "p",
+	"a", "ul", "ol", "sup", "sub", "li", "b", "i", "u", "strong", "em", "s",
+	"code", "hr", "br", "div", "table", "thead", "tbody", "tr", "th", "td",
+	"caption", "pre", "span", "img", "details", "summary",
+}
+
+// attributes allowed on each tag
+var allowedHTMLAttributes = map[string][]string{
+	"font": {"data-mx-bg-color", "data-mx-color", "color"},
+	"span": {"data-mx-bg-color", "data-mx-color", "data-mx-spoiler"},
+	"a":    {"name", "href"},
+	"img":  {"width", "height", "alt", "title", "src"},
+	"ol":   {"start"},
+	"code": {"class"},
+}
+
+// tags that are dropped along with everything inside them. Reply fallbacks
+// quote the replied to event, which may not be visible.
+var droppedHTMLTags = []string{
+	"mx-reply", "script", "style", "iframe", "object", "embed", "template",
+	"noscript", "title", "textarea", "select", "svg", "math",
+}
+
+var voidHTMLTags = []string{"br", "hr", "img"}
+
+var linkSchemes = []string{"http", "https", "ftp", "mailto", "magnet"}
+
+var codeLanguageClass = regexp.MustCompile(`^language-[\w+#-]+$`)
+
+// deepest nesting that's kept, as the spec suggests
+const maxHTMLDepth = 100
+
+// SanitizeMatrixHTML reduces the formatted body of a message to the tags
+// and attributes the spec allows. Images may only point at mxc URIs, which
+// media turns into fetchable URLs. Unbalanced tags are closed.
+func SanitizeMatrixHTML(s string, media func(mxc string) string) string {
+	var b strings.Builder
+
+	z := html.NewTokenizer(strings.NewReader(s))
+
+	open := []string{}
+	dropping := ""
+	dropped_depth := 0
+
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() != io.EOF {
+				return ""
+			}
+			break
+		}
+
+		switch tt {
+		case html.TextToken:
+			if dropping == "" {
+				b.WriteString(html.EscapeString(string(z.Text())))
+			}
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			name := tok.Data
+
+			if dropping != "" {
+				if name == dropping && tt == html.StartTagToken {
+					dropped_depth++
+				}
+				continue
+			}
+
+			if Contains(droppedHTMLTags, name) {
+				if tt == html.StartTagToken {
+					dropping = name
+					dropped_depth = 1
+				}
+				continue
+			}
+
+			if !Contains(allowedHTMLTags, name) {
+				continue
+			}
+
+			attrs, ok := sanitizeAttributes(name, tok.Attr, media)
+			if !ok {
+				continue
+			}
+
+			if Contains(voidHTMLTags, name) {
+				b.WriteString("<" + name + attrs + ">")
+				continue
+			}
+
+			if len(open) >= maxHTMLDepth {
+				continue
+			}
+			open = append(open, name)
+			b.WriteString("<" + name + attrs + ">")
+
+		case html.EndTagToken:
+			name := z.Token().Data
+
+			if dropping != "" {
+				if name == dropping {
+					dropped_depth--
+					if dropped_depth == 0 {
+						dropping = ""
+					}
+				}
+				continue
+			}
+
+			// close everything opened since the matching tag
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] != name {
+					continue
+				}
+				for j := len(open) - 1; j >= i; j-- {
+					b.WriteString("</" + open[j] + ">")
+				}
+				open = open[:i]
+				break
+			}
+		}
+	}
+
+	for i := len(open) - 1; i >= 0; i-- {
+		b.WriteString("</" + open[i] + ">")
+	}
+
+	return b.String()
+}
+
+// sanitizeAttributes renders the allowed attributes of a tag. It returns
+// false if the tag should be dropped, such as an image without a usable
+// source.
+func sanitizeAttributes(tag string, attrs []html.Attribute, media func(string) string) (string, bool) {
+	var b strings.Builder
+
+	allowed := allowedHTMLAttributes[tag]
+	has_src := false
+
+	for _, attr := range attrs {
+		key := strings.ToLower(attr.Key)
+		val := attr.Val
+
+		if !Contains(allowed, key) {
+			continue
+		}
+
+		switch {
+		case tag == "a" && key == "href":
+			u, err := url.Parse(val)
+			if err != nil || !Contains(linkSchemes, strings.ToLower(u.Scheme)) {
+				continue
+			}
+		case tag == "img" && key == "src":
+			if _, _, ok := ParseMXC(val); !ok {
+				return "", false
+			}
+			val = media(val)
+			has_src = true
+		case key == "width", key == "height", key == "start":
+			if _, err := strconv.Atoi(val); err != nil {
+				continue
+			}
+		case key == "class":
+			if !codeLanguageClass.MatchString(val) {
+				continue
+			}
+		}
+
+		b.WriteString(" " + key + `="` + html.EscapeString(val) + `"`)
+	}
+
+	if tag == "img" && !has_src {
+		return "", false
+	}
+
+	// links posted by others shouldn't pass on any ranking
+	if tag == "a" {
+		b.WriteString(` rel="nofollow ugc noopener"`)
+	}
+
+	return b.String(), true
+}
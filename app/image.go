@@ -0,0 +1,365 @@
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+var errImageUnsupported = errors.New("unsupported image")
+
+// thumbnail sizes are snapped up to one of these, so that arbitrary sizes
+// can't fill the cache with variants
+var thumbnailSizes = []int{32, 64, 96, 128, 256, 320, 480, 640, 800, 1024, 1280, 1600, 1920}
+
+// image types that are decoded and re-encoded locally
+var decodableImageTypes = []string{
+	"image/jpeg",
+	"image/png",
+	"image/gif",
+	"image/webp",
+}
+
+// decoded images take four bytes a pixel, so only a few are worked on at once
+const maxConcurrentImages = 2
+
+var imageSlots = make(chan struct{}, maxConcurrentImages)
+
+// acquireImageSlot waits until an image may be decoded. The slot is released
+// with releaseImageSlot once the decoded image is no longer needed.
+func acquireImageSlot() {
+	imageSlots <- struct{}{}
+}
+
+func releaseImageSlot() {
+	<-imageSlots
+}
+
+// SnapThumbnailSize rounds a requested dimension up to the nearest supported
+// size, capped at the largest.
+func SnapThumbnailSize(n int) int {
+	for _, size := range thumbnailSizes {
+		if n <= size {
+			return size
+		}
+	}
+	return thumbnailSizes[len(thumbnailSizes)-1]
+}
+
+// SnapThumbnailDimensions snaps the larger of a requested width and height to
+// a supported size, and scales the other to keep the requested aspect ratio,
+// which crops depend on.
+func SnapThumbnailDimensions(width, height int) (int, int) {
+	if width >= height {
+		size := SnapThumbnailSize(width)
+		return size, max(1, (height*size+width/2)/width)
+	}
+	size := SnapThumbnailSize(height)
+	return max(1, (width*size+height/2)/height), size
+}
+
+// ImagePipeline decodes, resizes and re-encodes images. Re-encoding drops
+// EXIF and any other metadata, after applying the EXIF orientation.
+type ImagePipeline struct {
+	MaxBytes  int64
+	MaxPixels int64
+}
+
+func (c *App) ImagePipeline() *ImagePipeline {
+	p := &ImagePipeline{
+		MaxBytes:  c.Config.Media.MaxImageSize * 1024 * 1024,
+		MaxPixels: c.Config.Media.MaxImagePixels * 1000 * 1000,
+	}
+	if p.MaxBytes <= 0 {
+		p.MaxBytes = 20 * 1024 * 1024
+	}
+	if p.MaxPixels <= 0 {
+		p.MaxPixels = 32 * 1000 * 1000
+	}
+	return p
+}
+
+// EncodedImage is the output of the pipeline.
+type EncodedImage struct {
+	Data        []byte
+	ContentType string
+}
+
+// Decode reads an image within the configured limits. Its dimensions are
+// checked before it's decoded, so oversized images are never allocated.
+// Callers hold an image slot for as long as they use the image.
+func (p *ImagePipeline) Decode(f *os.File, content_type string) (image.Image, error) {
+	if !Contains(decodableImageTypes, content_type) {
+		return nil, errImageUnsupported
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > p.MaxBytes {
+		return nil, fmt.Errorf("image is larger than %d bytes", p.MaxBytes)
+	}
+
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	if int64(config.Width)*int64(config.Height) > p.MaxPixels {
+		return nil, fmt.Errorf("image is larger than %d pixels", p.MaxPixels)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+
+	if content_type == "image/jpeg" {
+		img = Orient(img, JPEGOrientation(b))
+	}
+
+	return img, nil
+}
+
+// Thumbnail resizes an image to fit within width and height, or with crop,
+// to fill them exactly. Images are never scaled up.
+func (p *ImagePipeline) Thumbnail(f *os.File, content_type string, width, height int, method string) (*EncodedImage, error) {
+	acquireImageSlot()
+	defer releaseImageSlot()
+
+	img, err := p.Decode(f, content_type)
+	if err != nil {
+		return nil, err
+	}
+
+	var out image.Image
+	if method == "crop" {
+		out = CropImage(img, width, height)
+	} else {
+		out = ScaleImage(img, width, height)
+	}
+
+	return Encode(out)
+}
+
+// Reencode passes an image through the pipeline at its original size. GIFs
+// are left alone, as re-encoding would flatten animations to a single frame.
+func (p *ImagePipeline) Reencode(f *os.File, content_type string) (*EncodedImage, error) {
+	if content_type == "image/gif" {
+		return nil, errImageUnsupported
+	}
+
+	acquireImageSlot()
+	defer releaseImageSlot()
+
+	img, err := p.Decode(f, content_type)
+	if err != nil {
+		return nil, err
+	}
+	return Encode(img)
+}
+
+func ScaleImage(img image.Image, width, height int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	if w <= width && h <= height {
+		return img
+	}
+
+	// fit the longer side, keeping the aspect ratio
+	if w*height > h*width {
+		h = max(1, h*width/w)
+		w = width
+	} else {
+		w = max(1, w*height/h)
+		h = height
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+func CropImage(img image.Image, width, height int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	// without upscaling, the crop can't be bigger than the image
+	width = min(width, w)
+	height = min(height, h)
+
+	// the largest part of the image with the target aspect ratio, centred
+	crop_w, crop_h := w, h
+	if w*height > h*width {
+		crop_w = h * width / height
+	} else {
+		crop_h = w * height / width
+	}
+
+	x := b.Min.X + (w-crop_w)/2
+	y := b.Min.Y + (h-crop_h)/2
+	src := image.Rect(x, y, x+crop_w, y+crop_h)
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, src, draw.Src, nil)
+	return dst
+}
+
+// Encode writes opaque images as JPEG and images with transparency as PNG.
+func Encode(img image.Image) (*EncodedImage, error) {
+	var buf bytes.Buffer
+
+	if IsOpaque(img) {
+		err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+		return &EncodedImage{Data: buf.Bytes(), ContentType: "image/jpeg"}, err
+	}
+
+	err := png.Encode(&buf, img)
+	return &EncodedImage{Data: buf.Bytes(), ContentType: "image/png"}, err
+}
+
+func IsOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+// JPEGOrientation reads the EXIF orientation tag from a JPEG, or returns 1
+// (upright) if there isn't one.
+func JPEGOrientation(b []byte) int {
+	if len(b) < 4 || b[0] != 0xFF || b[1] != 0xD8 {
+		return 1
+	}
+
+	i := 2
+	for i+4 <= len(b) {
+		if b[i] != 0xFF {
+			return 1
+		}
+		marker := b[i+1]
+		size := int(binary.BigEndian.Uint16(b[i+2:]))
+		if size < 2 || i+2+size > len(b) {
+			return 1
+		}
+
+		// APP1 holds EXIF, and it comes before the image data
+		if marker == 0xE1 {
+			return exifOrientation(b[i+4 : i+2+size])
+		}
+		if marker == 0xDA {
+			return 1
+		}
+
+		i += 2 + size
+	}
+
+	return 1
+}
+
+func exifOrientation(b []byte) int {
+	if len(b) < 14 || string(b[:6]) != "Exif\x00\x00" {
+		return 1
+	}
+	tiff := b[6:]
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	offset := int(order.Uint32(tiff[4:]))
+	if offset+2 > len(tiff) {
+		return 1
+	}
+
+	entries := int(order.Uint16(tiff[offset:]))
+	for n := 0; n < entries; n++ {
+		entry := offset + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+
+	return 1
+}
+
+// Orient turns an image upright according to its EXIF orientation.
+func Orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	// copying pixels out of an RGBA image is much faster than At and Set
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	src, ok := img.(*image.RGBA)
+	if !ok || src.Rect.Min != (image.Point{}) {
+		src = image.NewRGBA(image.Rect(0, 0, w, h))
+		draw.Draw(src, src.Rect, img, b.Min, draw.Src)
+	}
+
+	// orientations 5 to 8 swap width and height
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			s := src.PixOffset(x, y)
+			d := dst.PixOffset(dx, dy)
+			copy(dst.Pix[d:d+4], src.Pix[s:s+4])
+		}
+	}
+
+	return dst
+}
@@ -0,0 +1,575 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// downloads are bounded by the request's context too, but background work
+// may not have a deadline of its own
+var mediaClient = &http.Client{Timeout: 5 * time.Minute}
+
+var mxcPattern = regexp.MustCompile(`mxc://([A-Za-z0-9.:\[\]-]+)/([A-Za-z0-9_-]+)`)
+
+// media types that are safe to show inline, everything else is served as an
+// attachment
+var inlineMediaTypes = []string{
+	"image/jpeg",
+	"image/png",
+	"image/gif",
+	"image/webp",
+	"image/apng",
+	"image/avif",
+	"video/mp4",
+	"video/webm",
+	"video/ogg",
+	"audio/mpeg",
+	"audio/mp4",
+	"audio/ogg",
+	"audio/webm",
+	"audio/wav",
+	"audio/aac",
+	"audio/flac",
+	"text/plain",
+}
+
+// the rooms that reference some media. Media in state is referenced by the
+// room ID alone, media in events by the room ID and event ID, separated by a
+// space, so that it can be dropped along with the event.
+func mediaRefsKey(server, media_id string) string {
+	return fmt.Sprintf("media_refs:%s/%s", server, media_id)
+}
+
+// the media an event references, as server/media_id
+func eventMediaKey(event_id string) string {
+	return fmt.Sprintf("event_media:%s", event_id)
+}
+
+// ExtractMXC finds every mxc URI in a value, including ones embedded in
+// strings like formatted message bodies.
+func ExtractMXC(v any) []string {
+	found := []string{}
+
+	var walk func(v any)
+	walk = func(v any) {
+		switch val := v.(type) {
+		case string:
+			if strings.Contains(val, "mxc://") {
+				found = append(found, mxcPattern.FindAllString(val, -1)...)
+			}
+		case map[string]any:
+			for _, child := range val {
+				walk(child)
+			}
+		case []any:
+			for _, child := range val {
+				walk(child)
+			}
+		}
+	}
+
+	walk(v)
+	return found
+}
+
+// ParseMXC splits an mxc URI into its server name and media ID.
+func ParseMXC(mxc string) (string, string, bool) {
+	m := mxcPattern.FindStringSubmatch(mxc)
+	if m == nil || m[0] != mxc {
+		return "", "", false
+	}
+	return m[1], m[2], true
+}
+
+// IndexMedia records that a room references some media, so that it may be
+// served to anonymous users while the room is exposed. The event ID is empty
+// for media in room state.
+func (c *App) IndexMedia(room_id id.RoomID, event_id string, uris []string) {
+	ctx := context.Background()
+
+	ref := room_id.String()
+	if event_id != "" {
+		ref += " " + event_id
+	}
+
+	for _, uri := range uris {
+		server, media_id, ok := ParseMXC(uri)
+		if !ok {
+			continue
+		}
+		err := c.Cache.Rooms.SAdd(ctx, mediaRefsKey(server, media_id), ref).Err()
+		if err != nil {
+			c.Log.Error().Msgf("Couldn't index media %v", err)
+			return
+		}
+		if event_id != "" {
+			err := c.Cache.Rooms.SAdd(ctx, eventMediaKey(event_id), server+"/"+media_id).Err()
+			if err != nil {
+				c.Log.Error().Msgf("Couldn't index media %v", err)
+				return
+			}
+		}
+	}
+}
+
+// IndexEventMedia indexes the media in an event's content, if the event may
+// be shown. Member avatars are left out unless members are shown in full.
+func (c *App) IndexEventMedia(f *EventFilter, ev map[string]any) {
+	if !f.Visible(ev) {
+		return
+	}
+	if IsMemberEvent(ev) && f.MemberPrivacy != MemberPrivacyFull {
+		return
+	}
+
+	event_id, _ := ev["event_id"].(string)
+	content, _ := ev["content"].(map[string]any)
+
+	c.IndexMedia(f.RoomID, event_id, ExtractMXC(content))
+}
+
+// IndexNewEventMedia indexes the media in an event from a transaction,
+// filtered like the timeline it will be served in.
+func (c *App) IndexNewEventMedia(evt *event.Event) {
+	f, err := c.NewEventFilter(evt.RoomID)
+	if err != nil {
+		c.Log.Error().Msgf("Error building event filter: %v", err)
+		return
+	}
+
+	b, err := json.Marshal(evt)
+	if err != nil {
+		return
+	}
+	var ev map[string]any
+	if err := DecodeJSON(b, &ev); err != nil {
+		return
+	}
+
+	c.IndexEventMedia(f, ev)
+}
+
+// RemoveEventMedia drops the references an event made, after it's redacted
+// or hidden. Media that's referenced elsewhere stays available.
+func (c *App) RemoveEventMedia(event_id string) {
+	ctx := context.Background()
+
+	media, err := c.Cache.Rooms.SMembers(ctx, eventMediaKey(event_id)).Result()
+	if err != nil {
+		c.Log.Error().Msgf("Error reading event media: %v", err)
+		return
+	}
+
+	for _, m := range media {
+		key := "media_refs:" + m
+
+		refs, err := c.Cache.Rooms.SMembers(ctx, key).Result()
+		if err != nil {
+			continue
+		}
+		for _, ref := range refs {
+			if _, ref_event, ok := strings.Cut(ref, " "); ok && ref_event == event_id {
+				c.Cache.Rooms.SRem(ctx, key, ref)
+			}
+		}
+	}
+
+	if err := c.Cache.Rooms.Del(ctx, eventMediaKey(event_id)).Err(); err != nil {
+		c.Log.Error().Msgf("Couldn't remove event media: %v", err)
+	}
+}
+
+// IndexStateMedia indexes the media referenced by a room's state, such as
+// its avatar and banner.
+func (c *App) IndexStateMedia(room_id id.RoomID, state mautrix.RoomStateMap) {
+	uris := []string{}
+	for evt, events := range state {
+		// member avatars aren't shown unless members are
+		if evt == event.StateMember && c.MemberPrivacy(room_id) != MemberPrivacyFull {
+			continue
+		}
+		for _, ev := range events {
+			uris = append(uris, ExtractMXC(ev.Content.Raw)...)
+		}
+	}
+	c.IndexMedia(room_id, "", uris)
+}
+
+// MediaExposed reports whether media is referenced in at least one exposed
+// room.
+func (c *App) MediaExposed(server, media_id string) bool {
+	refs, err := c.Cache.Rooms.SMembers(context.Background(), mediaRefsKey(server, media_id)).Result()
+	if err != nil {
+		c.Log.Error().Msgf("Error reading media references: %v", err)
+		return false
+	}
+
+	for _, ref := range refs {
+		room, _, _ := strings.Cut(ref, " ")
+		if c.RoomExposure(id.RoomID(room)) == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MediaRequest is a download or thumbnail request for a piece of media.
+type MediaRequest struct {
+	Server    string
+	MediaID   string
+	Thumbnail bool
+	Width     int
+	Height    int
+	Method    string
+	Animated  bool
+}
+
+// CacheKey identifies the media and, for thumbnails, its size and method.
+func (m *MediaRequest) CacheKey() string {
+	if !m.Thumbnail {
+		return fmt.Sprintf("download/%s/%s", m.Server, m.MediaID)
+	}
+	return fmt.Sprintf("thumbnail/%s/%s/%dx%d/%s/%t", m.Server, m.MediaID, m.Width, m.Height, m.Method, m.Animated)
+}
+
+func (m *MediaRequest) query() url.Values {
+	q := url.Values{}
+	if m.Thumbnail {
+		q.Set("width", strconv.Itoa(m.Width))
+		q.Set("height", strconv.Itoa(m.Height))
+		q.Set("method", m.Method)
+		if m.Animated {
+			q.Set("animated", "true")
+		}
+	}
+	return q
+}
+
+// FetchMedia downloads media from the homeserver with the appservice token.
+// Authenticated media is tried first, falling back to the legacy endpoints
+// for homeservers that don't support it.
+func (c *App) FetchMedia(ctx context.Context, m *MediaRequest) (*http.Response, error) {
+	kind := "download"
+	if m.Thumbnail {
+		kind = "thumbnail"
+	}
+
+	urls := []string{
+		fmt.Sprintf("%s/_matrix/client/v1/media/%s/%s/%s", c.Config.Matrix.Homeserver, kind, m.Server, m.MediaID),
+		fmt.Sprintf("%s/_matrix/media/v3/%s/%s/%s", c.Config.Matrix.Homeserver, kind, m.Server, m.MediaID),
+	}
+
+	var resp *http.Response
+
+	for i, u := range urls {
+		if q := m.query().Encode(); q != "" {
+			u = u + "?" + q
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.Config.AppService.AccessToken))
+
+		resp, err = mediaClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		unsupported := resp.StatusCode == http.StatusNotFound ||
+			resp.StatusCode == http.StatusMethodNotAllowed ||
+			resp.StatusCode == http.StatusBadRequest
+		if !unsupported || i == len(urls)-1 {
+			break
+		}
+
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	return resp, nil
+}
+
+// ContentDisposition only lets media types that are safe to render be shown
+// inline.
+func ContentDisposition(content_type, filename string) string {
+	disposition := "attachment"
+	if Contains(inlineMediaTypes, content_type) {
+		disposition = "inline"
+	}
+	if filename == "" {
+		return disposition
+	}
+	return fmt.Sprintf("%s; filename*=utf-8''%s", disposition, url.PathEscape(filename))
+}
+
+func parseMediaRequest(r *http.Request, thumbnail bool) (*MediaRequest, error) {
+	m := &MediaRequest{
+		Server:    chi.URLParam(r, "server_name"),
+		MediaID:   chi.URLParam(r, "media_id"),
+		Thumbnail: thumbnail,
+	}
+
+	if _, _, ok := ParseMXC(fmt.Sprintf("mxc://%s/%s", m.Server, m.MediaID)); !ok {
+		return nil, fmt.Errorf("invalid media ID")
+	}
+
+	if !thumbnail {
+		return m, nil
+	}
+
+	q := r.URL.Query()
+
+	width, err := strconv.Atoi(q.Get("width"))
+	if err != nil || width <= 0 {
+		return nil, fmt.Errorf("width must be a positive integer")
+	}
+	height, err := strconv.Atoi(q.Get("height"))
+	if err != nil || height <= 0 {
+		return nil, fmt.Errorf("height must be a positive integer")
+	}
+
+	m.Width, m.Height = SnapThumbnailDimensions(width, height)
+
+	m.Method = q.Get("method")
+	if m.Method == "" {
+		m.Method = "scale"
+	}
+	if m.Method != "scale" && m.Method != "crop" {
+		return nil, fmt.Errorf("method must be scale or crop")
+	}
+
+	m.Animated = q.Get("animated") == "true"
+
+	return m, nil
+}
+
+func (c *App) MediaProxy(thumbnail bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		m, err := parseMediaRequest(r, thumbnail)
+		if err != nil {
+			RespondWithError(w, &JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: map[string]any{
+					"errcode": "M_INVALID_PARAM",
+					"error":   err.Error(),
+				},
+			})
+			return
+		}
+
+		if !c.MediaExposed(m.Server, m.MediaID) {
+			RespondWithError(w, &JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: map[string]any{
+					"errcode": "M_NOT_FOUND",
+					"error":   "Media not found.",
+				},
+			})
+			return
+		}
+
+		cached, err := c.MediaCache().Get(m.CacheKey())
+		if err != nil {
+			cached, err = c.ProcessMedia(r.Context(), m)
+		}
+
+		if err == errMediaNotFound {
+			RespondWithError(w, &JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: map[string]any{
+					"errcode": "M_NOT_FOUND",
+					"error":   "Media not found.",
+				},
+			})
+			return
+		}
+
+		if err == errMediaTooLarge {
+			RespondWithError(w, &JSONResponse{
+				Code: http.StatusBadGateway,
+				JSON: map[string]any{
+					"errcode": "M_TOO_LARGE",
+					"error":   "Media is too large to proxy.",
+				},
+			})
+			return
+		}
+
+		if err != nil {
+			c.Log.Error().Msgf("Error fetching media: %v", err)
+			RespondWithError(w, &JSONResponse{
+				Code: http.StatusBadGateway,
+				JSON: map[string]any{
+					"errcode": "M_UNKNOWN",
+					"error":   "Error fetching media from homeserver.",
+				},
+			})
+			return
+		}
+		defer cached.Close()
+
+		filename := chi.URLParam(r, "file_name")
+		if filename == "" {
+			filename = cached.Meta.Filename
+		}
+
+		w.Header().Set("Content-Type", cached.Meta.ContentType)
+		w.Header().Set("Content-Disposition", ContentDisposition(cached.Meta.ContentType, filename))
+		w.Header().Set("Content-Security-Policy", "sandbox; default-src 'none'; script-src 'none'; plugin-types application/pdf; style-src 'unsafe-inline'; media-src 'self'; object-src 'self';")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Cross-Origin-Resource-Policy", "cross-origin")
+		w.Header().Set("Cache-Control", "public, max-age=86400, immutable")
+
+		http.ServeContent(w, r, "", cached.Meta.Fetched, cached.File)
+	}
+}
+
+// ProcessMedia produces and caches the requested media. Thumbnails are made
+// locally from the original where possible, and downloaded images are
+// re-encoded if configured, to strip their metadata. Anything the image
+// pipeline can't handle falls back to what the homeserver returns.
+func (c *App) ProcessMedia(ctx context.Context, m *MediaRequest) (*CachedMedia, error) {
+
+	if !m.Thumbnail && !c.Config.Media.ReencodeImages {
+		return c.fetchAndCacheMedia(ctx, m)
+	}
+
+	original := &MediaRequest{
+		Server:  m.Server,
+		MediaID: m.MediaID,
+	}
+
+	// the untouched original is cached separately from what's served
+	key := original.CacheKey() + "/original"
+
+	src, err := c.MediaCache().Get(key)
+	if err != nil {
+		src, err = c.fetchOriginalImage(ctx, original, key)
+	}
+	if err == errMediaNotFound {
+		return nil, err
+	}
+	if err != nil {
+		if err != errImageUnsupported {
+			c.Log.Info().Msgf("Couldn't fetch original of mxc://%s/%s: %v", m.Server, m.MediaID, err)
+		}
+		// the homeserver's thumbnail, or the download as it is
+		return c.fetchAndCacheMedia(ctx, m)
+	}
+	defer src.Close()
+
+	pipeline := c.ImagePipeline()
+
+	var img *EncodedImage
+	if m.Thumbnail {
+		img, err = pipeline.Thumbnail(src.File, src.Meta.ContentType, m.Width, m.Height, m.Method)
+	} else {
+		img, err = pipeline.Reencode(src.File, src.Meta.ContentType)
+	}
+
+	if err != nil {
+		if err != errImageUnsupported {
+			c.Log.Info().Msgf("Couldn't process mxc://%s/%s locally: %v", m.Server, m.MediaID, err)
+		}
+		if m.Thumbnail {
+			return c.fetchAndCacheMedia(ctx, m)
+		}
+		// not an image we can re-encode, so it's served as it is
+		src.File.Seek(0, io.SeekStart)
+		return c.MediaCache().Put(m.CacheKey(), src.File, src.Meta)
+	}
+
+	return c.MediaCache().Put(m.CacheKey(), bytes.NewReader(img.Data), MediaMeta{
+		ContentType: img.ContentType,
+		Filename:    src.Meta.Filename,
+	})
+}
+
+func (c *App) fetchAndCacheMedia(ctx context.Context, m *MediaRequest) (*CachedMedia, error) {
+	return c.fetchAndCacheMediaAs(ctx, m, m.CacheKey())
+}
+
+func (c *App) fetchAndCacheMediaAs(ctx context.Context, m *MediaRequest, key string) (*CachedMedia, error) {
+	resp, err := c.fetchMediaOK(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return c.cacheMediaResponse(resp, key)
+}
+
+// fetchOriginalImage downloads and caches an original for the image
+// pipeline. Media the pipeline wouldn't decode isn't downloaded at all, and
+// errImageUnsupported is returned instead.
+func (c *App) fetchOriginalImage(ctx context.Context, m *MediaRequest, key string) (*CachedMedia, error) {
+	resp, err := c.fetchMediaOK(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if !Contains(decodableImageTypes, mediaContentType(resp)) || resp.ContentLength > c.ImagePipeline().MaxBytes {
+		return nil, errImageUnsupported
+	}
+
+	return c.cacheMediaResponse(resp, key)
+}
+
+// fetchMediaOK fetches media and turns anything but a 200 into an error.
+func (c *App) fetchMediaOK(ctx context.Context, m *MediaRequest) (*http.Response, error) {
+	resp, err := c.FetchMedia(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, errMediaNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("homeserver responded with %s", resp.Status)
+	}
+
+	return resp, nil
+}
+
+func mediaContentType(resp *http.Response) string {
+	if content_type := resp.Header.Get("Content-Type"); content_type != "" {
+		return content_type
+	}
+	return "application/octet-stream"
+}
+
+func (c *App) cacheMediaResponse(resp *http.Response, key string) (*CachedMedia, error) {
+	content_type := mediaContentType(resp)
+
+	filename := ""
+	if disposition := resp.Header.Get("Content-Disposition"); disposition != "" {
+		filename = DispositionFilename(disposition)
+	}
+
+	return c.MediaCache().Put(key, resp.Body, MediaMeta{
+		ContentType: content_type,
+		Filename:    filename,
+	})
+}
@@ -0,0 +1,241 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	errMediaNotFound = errors.New("media not found")
+	errMediaTooLarge = errors.New("media too large")
+	errMediaExpired  = errors.New("cached media expired")
+)
+
+// MediaMeta is stored next to each cached file.
+type MediaMeta struct {
+	ContentType string    `json:"content_type"`
+	Filename    string    `json:"filename,omitempty"`
+	Fetched     time.Time `json:"fetched"`
+}
+
+type CachedMedia struct {
+	File *os.File
+	Meta MediaMeta
+}
+
+func (m *CachedMedia) Close() error {
+	return m.File.Close()
+}
+
+// MediaCache keeps proxied media on disk, within a total size and a maximum
+// age.
+type MediaCache struct {
+	Dir         string
+	MaxSize     int64
+	MaxAge      time.Duration
+	MaxFileSize int64
+}
+
+func (c *App) MediaCache() *MediaCache {
+	m := &MediaCache{
+		Dir:         c.Config.Media.CacheDir,
+		MaxSize:     c.Config.Media.MaxCacheSize * 1024 * 1024,
+		MaxAge:      time.Duration(c.Config.Media.MaxAge) * time.Second,
+		MaxFileSize: c.Config.Media.MaxFileSize * 1024 * 1024,
+	}
+
+	if m.Dir == "" {
+		m.Dir = "media-cache"
+	}
+	if m.MaxSize <= 0 {
+		m.MaxSize = 1024 * 1024 * 1024
+	}
+	if m.MaxAge <= 0 {
+		m.MaxAge = 7 * 24 * time.Hour
+	}
+	if m.MaxFileSize <= 0 {
+		m.MaxFileSize = 50 * 1024 * 1024
+	}
+
+	return m
+}
+
+// files are sharded by the first two characters of the hashed key
+func (m *MediaCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(m.Dir, name[:2], name)
+}
+
+// Get opens a cached file, if there is one that hasn't expired.
+func (m *MediaCache) Get(key string) (*CachedMedia, error) {
+	path := m.path(key)
+
+	b, err := os.ReadFile(path + ".json")
+	if err != nil {
+		return nil, err
+	}
+
+	var meta MediaMeta
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return nil, err
+	}
+
+	if time.Since(meta.Fetched) > m.MaxAge {
+		return nil, errMediaExpired
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CachedMedia{File: f, Meta: meta}, nil
+}
+
+// Put writes media to the cache and opens it. The file is written under a
+// temporary name first, so readers never see a partial file.
+func (m *MediaCache) Put(key string, r io.Reader, meta MediaMeta) (*CachedMedia, error) {
+	path := m.path(key)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, io.LimitReader(r, m.MaxFileSize+1))
+	tmp.Close()
+	if err != nil {
+		return nil, err
+	}
+	if n > m.MaxFileSize {
+		return nil, errMediaTooLarge
+	}
+
+	meta.Fetched = time.Now()
+
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(path+".json", b, 0o644); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CachedMedia{File: f, Meta: meta}, nil
+}
+
+// Clean removes expired files, then the least recently fetched ones until
+// the cache fits in its maximum size.
+func (m *MediaCache) Clean() (int, error) {
+	type cached struct {
+		path    string
+		size    int64
+		modtime time.Time
+	}
+
+	files := []cached{}
+	var total int64
+	removed := 0
+
+	err := filepath.WalkDir(m.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(path, ".json") {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		// leftovers from interrupted downloads
+		if strings.HasPrefix(d.Name(), ".tmp-") {
+			if time.Since(info.ModTime()) > time.Hour {
+				os.Remove(path)
+			}
+			return nil
+		}
+
+		if time.Since(info.ModTime()) > m.MaxAge {
+			os.Remove(path)
+			os.Remove(path + ".json")
+			removed++
+			return nil
+		}
+
+		files = append(files, cached{path, info.Size(), info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return removed, err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modtime.Before(files[j].modtime)
+	})
+
+	for _, f := range files {
+		if total <= m.MaxSize {
+			break
+		}
+		os.Remove(f.path)
+		os.Remove(f.path + ".json")
+		total -= f.size
+		removed++
+	}
+
+	return removed, nil
+}
+
+func (c *App) CleanMediaCache() {
+	removed, err := c.MediaCache().Clean()
+	if err != nil {
+		c.Log.Error().Msgf("Error cleaning media cache: %v", err)
+		return
+	}
+	c.Log.Info().Msgf("Removed %d files from media cache", removed)
+}
+
+// DispositionFilename reads the filename from a Content-Disposition header.
+func DispositionFilename(disposition string) string {
+	_, params, err := mime.ParseMediaType(disposition)
+	if err != nil {
+		return ""
+	}
+	if params["filename"] == "" {
+		return ""
+	}
+	return filepath.Base(params["filename"])
+}
@@ -0,0 +1,133 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// the mxc source of an <img> tag in a formatted body, after the text before it
+var imgSrcPattern = regexp.MustCompile(`(?i)(<img\b[^>]*?\ssrc\s*=\s*["']?)(mxc://[^"'\s>]+)`)
+
+// MediaURL returns the media proxy URL for an mxc URI, or the URI as it is
+// if it isn't valid.
+func (c *App) MediaURL(mxc string) string {
+	server, media_id, ok := ParseMXC(mxc)
+	if !ok {
+		return mxc
+	}
+	return fmt.Sprintf("%s/_matrix/client/v1/media/download/%s/%s", c.PublicURL(), server, media_id)
+}
+
+// ThumbnailURL returns the media proxy URL for a thumbnail of an mxc URI,
+// scaled to fit within width and height.
+func (c *App) ThumbnailURL(mxc string, width, height int) string {
+	server, media_id, ok := ParseMXC(mxc)
+	if !ok {
+		return mxc
+	}
+	return fmt.Sprintf("%s/_matrix/client/v1/media/thumbnail/%s/%s?width=%d&height=%d&method=scale", c.PublicURL(), server, media_id, width, height)
+}
+
+// PublicURL is the base URL this service is reached at.
+func (c *App) PublicURL() string {
+	if c.Config.App.PublicURL != "" {
+		return strings.TrimSuffix(c.Config.App.PublicURL, "/")
+	}
+	return fmt.Sprintf("https://%s", c.Config.App.Domain)
+}
+
+// RewriteMXC replaces mxc URIs in a decoded JSON value with media proxy URLs.
+// Strings that are entirely an mxc URI are replaced, as are the <img> sources
+// inside formatted message bodies. Other text, links included, is left alone.
+func (c *App) RewriteMXC(v any, key string) any {
+	switch val := v.(type) {
+	case string:
+		if key == "formatted_body" && strings.Contains(val, "mxc://") {
+			return imgSrcPattern.ReplaceAllStringFunc(val, func(m string) string {
+				parts := imgSrcPattern.FindStringSubmatch(m)
+				return parts[1] + c.MediaURL(parts[2])
+			})
+		}
+		if strings.HasPrefix(val, "mxc://") {
+			return c.MediaURL(val)
+		}
+	case map[string]any:
+		for k, child := range val {
+			val[k] = c.RewriteMXC(child, k)
+		}
+	case []any:
+		for i, child := range val {
+			val[i] = c.RewriteMXC(child, "")
+		}
+	}
+	return v
+}
+
+// WantsMediaURLs reports whether a request opted in to having mxc URIs
+// rewritten, with ?media_urls=http or the X-Commune-Media-URLs header.
+func WantsMediaURLs(r *http.Request) bool {
+	return r.URL.Query().Get("media_urls") == "http" ||
+		strings.EqualFold(r.Header.Get("X-Commune-Media-URLs"), "http")
+}
+
+type bufferedResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+// ResolveMediaURLs rewrites mxc URIs in JSON responses for requests that
+// opted in. Other requests pass straight through.
+func (c *App) ResolveMediaURLs(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		// the same URL responds differently depending on the header
+		w.Header().Add("Vary", "X-Commune-Media-URLs")
+
+		if !WantsMediaURLs(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		// the response has to be read, so it can't be compressed
+		r.Header.Del("Accept-Encoding")
+
+		bw := &bufferedResponseWriter{ResponseWriter: w}
+		h.ServeHTTP(bw, r)
+
+		if bw.status == 0 {
+			bw.status = http.StatusOK
+		}
+
+		body := bw.body.Bytes()
+
+		if strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+			var v any
+			if err := DecodeJSON(body, &v); err == nil {
+				var buf bytes.Buffer
+				if err := writeJSON(&buf, c.RewriteMXC(v, "")); err == nil {
+					body = buf.Bytes()
+				}
+			}
+		}
+
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(bw.status)
+		w.Write(body)
+	})
+}
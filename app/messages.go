@@ -5,8 +5,6 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -30,10 +28,7 @@ func (w *CachingResponseWriter) Write(b []byte) (int, error) {
 
 func (c *App) MessagesProxy() http.HandlerFunc {
 
-	endpoint := fmt.Sprintf("%s/", c.Config.Matrix.Homeserver)
-	target, _ := url.Parse(endpoint)
-
-	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy := c.NewFilteringProxy()
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
@@ -2,6 +2,7 @@ package app
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"strings"
@@ -33,6 +34,25 @@ func (c *App) AuthenticatedAccessToken(r *http.Request) *string {
 
 }
 
+type peerAddrKey struct{}
+
+// KeepPeerAddr remembers the address a request came from, before RealIP
+// replaces it with one from headers the client controls.
+func KeepPeerAddr(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), peerAddrKey{}, r.RemoteAddr)
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// PeerAddr returns the address a request came from, as seen by the server.
+func PeerAddr(r *http.Request) string {
+	if addr, ok := r.Context().Value(peerAddrKey{}).(string); ok {
+		return addr
+	}
+	return r.RemoteAddr
+}
+
 // This ensures that request is from Synapse Homeserver
 func (c *App) AuthenticateHomeserver(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -136,36 +156,86 @@ func (c *App) ValidateRoomID(h http.Handler) http.Handler {
 	})
 }
 
+// This ensures the room has been joined by the appservice and is eligible to
+// be exposed under the configured policy.
 func (c *App) ValidatePublicRoom(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 		room_id := chi.URLParam(r, "room_id")
 
-		/*
-			// check if room exists in cache
-			info, err := c.Cache.Rooms.Get(context.Background(), room_id).Result()
-
-			if err == nil && info != "" {
-				h.ServeHTTP(w, r)
-				return
-			}
-		*/
+		err := c.RoomExposure(id.RoomID(room_id))
 
-		// if not found in cache, check if it's been joined by appservice
-		state, err := c.Matrix.State(context.Background(), id.RoomID(room_id))
-		if err == nil && state != nil {
+		if err == nil {
 			h.ServeHTTP(w, r)
 			return
 		}
 
+		if err == ErrRoomNotJoined {
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: map[string]any{
+					"errcode": "M_NOT_FOUND",
+					"error":   "Room not found.",
+				},
+			})
+			return
+		}
+
 		RespondWithJSON(w, &JSONResponse{
 			Code: http.StatusForbidden,
 			JSON: map[string]any{
-				"errcode": "M_NOT_FOUND",
-				"error":   "Room not found.",
+				"errcode": "M_FORBIDDEN",
+				"error":   fmt.Sprintf("Room is not publicly accessible: %v.", err),
 			},
 		})
-		return
-
 	})
 }
+
+// RequireEndpoint only lets the request through if room moderators haven't
+// turned off the given group of endpoints for the room.
+func (c *App) RequireEndpoint(group string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			room_id := chi.URLParam(r, "room_id")
+
+			endpoints, err := c.RoomEndpoints(id.RoomID(room_id))
+			if err != nil || !endpoints.Allows(group) {
+				RespondWithJSON(w, &JSONResponse{
+					Code: http.StatusForbidden,
+					JSON: map[string]any{
+						"errcode": "M_FORBIDDEN",
+						"error":   fmt.Sprintf("This room doesn't expose its %s.", group),
+					},
+				})
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// EndpointEnabled turns away requests for endpoints that configuration has
+// disabled for the room.
+func (c *App) EndpointEnabled(endpoint string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			room_id := chi.URLParam(r, "room_id")
+
+			if c.EndpointDisabled(id.RoomID(room_id), endpoint) {
+				RespondWithJSON(w, &JSONResponse{
+					Code: http.StatusForbidden,
+					JSON: map[string]any{
+						"errcode": "M_FORBIDDEN",
+						"error":   fmt.Sprintf("The %s endpoint is disabled for this room.", endpoint),
+					},
+				})
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
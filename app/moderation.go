@@ -0,0 +1,548 @@
+package app
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"maunium.net/go/mautrix/id"
+)
+
+// Things that can be hidden from the public view by local moderation,
+// independently of anything done on the homeserver.
+const (
+	HiddenEvents = "events"
+	HiddenUsers  = "users"
+	HiddenRooms  = "rooms"
+)
+
+const moderationAuditKey = "moderation:audit"
+
+// how many audit entries are kept
+const maxAuditEntries = 10000
+
+func hiddenKey(kind string) string {
+	return fmt.Sprintf("hidden:%s", kind)
+}
+
+func IsHiddenKind(kind string) bool {
+	return kind == HiddenEvents || kind == HiddenUsers || kind == HiddenRooms
+}
+
+// HiddenEntry records why and by whom something was hidden.
+type HiddenEntry struct {
+	Target string `json:"target"`
+	Reason string `json:"reason,omitempty"`
+	Actor  string `json:"actor"`
+	TS     int64  `json:"ts"`
+}
+
+// AuditEntry is a single local moderation action.
+type AuditEntry struct {
+	Action string `json:"action"`
+	Kind   string `json:"kind"`
+	Target string `json:"target"`
+	Reason string `json:"reason,omitempty"`
+	Actor  string `json:"actor"`
+	TS     int64  `json:"ts"`
+}
+
+// HiddenSet is a snapshot of everything hidden by local moderation. Methods
+// are safe to call on a nil *HiddenSet, which hides nothing.
+type HiddenSet struct {
+	Events map[string]bool
+	Users  map[string]bool
+	Rooms  map[string]bool
+}
+
+func (h *HiddenSet) HidesRoom(room_id string) bool {
+	return h != nil && h.Rooms[room_id]
+}
+
+func (h *HiddenSet) HidesUser(user_id string) bool {
+	return h != nil && h.Users[user_id]
+}
+
+// HidesEvent reports whether an event is hidden, either itself or because
+// its sender is.
+func (h *HiddenSet) HidesEvent(event_id, sender string) bool {
+	return h != nil && (h.Events[event_id] || h.Users[sender])
+}
+
+// IsHidden checks a single target, for when reading the whole set would be
+// wasteful.
+func (c *App) IsHidden(kind, target string) bool {
+	if target == "" {
+		return false
+	}
+	hidden, err := c.Cache.Rooms.HExists(context.Background(), hiddenKey(kind), target).Result()
+	if err != nil {
+		c.Log.Error().Msgf("Error checking hidden %s: %v", kind, err)
+	}
+	return hidden
+}
+
+// HiddenSet reads everything currently hidden by local moderation.
+func (c *App) HiddenSet() (*HiddenSet, error) {
+	ctx := context.Background()
+
+	h := &HiddenSet{}
+	sets := map[string]*map[string]bool{
+		HiddenEvents: &h.Events,
+		HiddenUsers:  &h.Users,
+		HiddenRooms:  &h.Rooms,
+	}
+
+	for kind, set := range sets {
+		keys, err := c.Cache.Rooms.HKeys(ctx, hiddenKey(kind)).Result()
+		if err != nil {
+			return nil, err
+		}
+		*set = make(map[string]bool, len(keys))
+		for _, key := range keys {
+			(*set)[key] = true
+		}
+	}
+
+	return h, nil
+}
+
+// Hidden lists everything of a kind hidden by local moderation.
+func (c *App) Hidden(kind string) ([]HiddenEntry, error) {
+	values, err := c.Cache.Rooms.HGetAll(context.Background(), hiddenKey(kind)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]HiddenEntry, 0, len(values))
+	for _, value := range values {
+		var entry HiddenEntry
+		if err := json.Unmarshal([]byte(value), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// Hide hides an event, user or room from every public endpoint.
+func (c *App) Hide(kind, target, reason, actor string) error {
+	if !IsHiddenKind(kind) {
+		return fmt.Errorf("unknown kind: %s", kind)
+	}
+
+	entry := HiddenEntry{
+		Target: target,
+		Reason: reason,
+		Actor:  actor,
+		TS:     time.Now().UnixMilli(),
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	err = c.Cache.Rooms.HSet(context.Background(), hiddenKey(kind), target, b).Err()
+	if err != nil {
+		return err
+	}
+
+	c.Log.Info().Msgf("Hid %s %s: %s", kind, target, reason)
+
+	c.Audit("hide", kind, target, reason, actor)
+	c.HiddenSetChanged(kind, target)
+
+	return nil
+}
+
+// Unhide reverses Hide. It returns false if the target wasn't hidden.
+func (c *App) Unhide(kind, target, reason, actor string) (bool, error) {
+	if !IsHiddenKind(kind) {
+		return false, fmt.Errorf("unknown kind: %s", kind)
+	}
+
+	n, err := c.Cache.Rooms.HDel(context.Background(), hiddenKey(kind), target).Result()
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		return false, nil
+	}
+
+	c.Log.Info().Msgf("Unhid %s %s", kind, target)
+
+	c.Audit("unhide", kind, target, reason, actor)
+	c.HiddenSetChanged(kind, target)
+
+	return true, nil
+}
+
+func (c *App) Audit(action, kind, target, reason, actor string) {
+	b, err := json.Marshal(AuditEntry{
+		Action: action,
+		Kind:   kind,
+		Target: target,
+		Reason: reason,
+		Actor:  actor,
+		TS:     time.Now().UnixMilli(),
+	})
+	if err != nil {
+		return
+	}
+
+	ctx := context.Background()
+
+	err = c.Cache.Rooms.LPush(ctx, moderationAuditKey, b).Err()
+	if err != nil {
+		c.Log.Error().Msgf("Couldn't record moderation audit entry: %v", err)
+		return
+	}
+
+	err = c.Cache.Rooms.LTrim(ctx, moderationAuditKey, 0, maxAuditEntries-1).Err()
+	if err != nil {
+		c.Log.Error().Msgf("Couldn't trim moderation audit log: %v", err)
+	}
+}
+
+// AuditLog returns the most recent local moderation actions, newest first.
+func (c *App) AuditLog(limit int64) ([]AuditEntry, error) {
+	values, err := c.Cache.Rooms.LRange(context.Background(), moderationAuditKey, 0, limit-1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]AuditEntry, 0, len(values))
+	for _, value := range values {
+		var entry AuditEntry
+		if err := json.Unmarshal([]byte(value), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// HiddenSetChanged drops cached responses that were built before the change.
+// Cached message pages are already filtered, so all of them have to go when
+// an event or user is hidden, since we can't tell which rooms they're in.
+func (c *App) HiddenSetChanged(kind, target string) {
+	if kind == HiddenRooms {
+		UnsubscribeRoom(target)
+		return
+	}
+
+	// media only the hidden event referenced stops being served
+	if kind == HiddenEvents && c.IsHidden(HiddenEvents, target) {
+		c.RemoveEventMedia(target)
+	}
+
+	c.ClearMessagesCache()
+}
+
+// ClearMessagesCache drops every room's cached message page, for changes
+// that may apply to any room.
+func (c *App) ClearMessagesCache() {
+	ctx := context.Background()
+
+	iter := c.Cache.Messages.Scan(ctx, 0, "!*", 500).Iterator()
+	for iter.Next(ctx) {
+		c.Cache.Messages.Del(ctx, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		c.Log.Error().Msgf("Couldn't clear messages cache: %v", err)
+	}
+}
+
+// FilterHiddenRooms removes hidden rooms from a listing, along with any
+// references to them as space children or parents. Hidden rooms are left in
+// the cached listing, so this is applied every time it's read.
+func (c *App) FilterHiddenRooms(rooms []PublicRoom) []PublicRoom {
+	hidden, err := c.HiddenSet()
+	if err != nil {
+		c.Log.Error().Msgf("Error reading hidden rooms: %v", err)
+		return rooms
+	}
+
+	if len(hidden.Rooms) == 0 {
+		return rooms
+	}
+
+	filtered := make([]PublicRoom, 0, len(rooms))
+	for _, room := range rooms {
+		if hidden.HidesRoom(room.RoomID) {
+			continue
+		}
+
+		children := []SpaceChild{}
+		room.Children = nil
+		for _, child := range room.SpaceChildren {
+			if hidden.HidesRoom(child.RoomID) {
+				continue
+			}
+			children = append(children, child)
+			room.Children = append(room.Children, child.RoomID)
+		}
+		room.SpaceChildren = children
+
+		parents := []string{}
+		for _, parent := range room.Parents {
+			if !hidden.HidesRoom(parent) {
+				parents = append(parents, parent)
+			}
+		}
+		room.Parents = parents
+
+		filtered = append(filtered, room)
+	}
+
+	return filtered
+}
+
+// This ensures the request carries the admin access token from the config.
+// Admin endpoints are off entirely if no token is configured.
+func (c *App) AuthenticateAdmin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		access_token, err := ExtractAccessToken(r)
+
+		if c.Config.Admin.AccessToken == "" ||
+			err != nil ||
+			access_token == nil ||
+			subtle.ConstantTimeCompare([]byte(*access_token), []byte(c.Config.Admin.AccessToken)) != 1 {
+
+			RespondWithJSON(w, &JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: map[string]any{
+					"errcode": "M_FORBIDDEN",
+					"error":   "Admin access token invalid.",
+				},
+			})
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+type ModerationRequest struct {
+	Reason string `json:"reason"`
+	Actor  string `json:"actor"`
+}
+
+func validHiddenTarget(kind, target string) bool {
+	switch kind {
+	case HiddenEvents:
+		return len(target) > 1 && target[0] == '$'
+	case HiddenUsers:
+		_, _, err := id.UserID(target).Parse()
+		return err == nil
+	case HiddenRooms:
+		return IsValidRoomID(target)
+	}
+	return false
+}
+
+func (c *App) ListHidden() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		kind := chi.URLParam(r, "kind")
+
+		if !IsHiddenKind(kind) {
+			RespondWithError(w, &JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: map[string]any{
+					"errcode": "M_INVALID_PARAM",
+					"error":   "Kind must be one of events, users or rooms.",
+				},
+			})
+			return
+		}
+
+		entries, err := c.Hidden(kind)
+		if err != nil {
+			c.Log.Error().Msgf("Error listing hidden %s: %v", kind, err)
+			RespondWithError(w, &JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: map[string]any{
+					"errcode": "M_UNKNOWN",
+					"error":   "Couldn't list hidden entries.",
+				},
+			})
+			return
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"hidden": entries,
+			},
+		})
+	}
+}
+
+func (c *App) SetHidden(hide bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		kind := chi.URLParam(r, "kind")
+		target := chi.URLParam(r, "target")
+
+		if !IsHiddenKind(kind) || !validHiddenTarget(kind, target) {
+			RespondWithError(w, &JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: map[string]any{
+					"errcode": "M_INVALID_PARAM",
+					"error":   "Invalid kind or target.",
+				},
+			})
+			return
+		}
+
+		var req ModerationRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				RespondWithError(w, &JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: map[string]any{
+						"errcode": "M_NOT_JSON",
+						"error":   "Request body must be JSON.",
+					},
+				})
+				return
+			}
+		}
+
+		if req.Actor == "" {
+			req.Actor = "admin-api"
+		}
+
+		var err error
+		found := true
+
+		if hide {
+			err = c.Hide(kind, target, req.Reason, req.Actor)
+		} else {
+			found, err = c.Unhide(kind, target, req.Reason, req.Actor)
+		}
+
+		if err != nil {
+			c.Log.Error().Msgf("Error updating hidden %s: %v", kind, err)
+			RespondWithError(w, &JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: map[string]any{
+					"errcode": "M_UNKNOWN",
+					"error":   "Couldn't update hidden entries.",
+				},
+			})
+			return
+		}
+
+		if !found {
+			RespondWithError(w, &JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: map[string]any{
+					"errcode": "M_NOT_FOUND",
+					"error":   "Not hidden.",
+				},
+			})
+			return
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{},
+		})
+	}
+}
+
+func (c *App) ModerationAuditLog() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		entries, err := c.AuditLog(100)
+		if err != nil {
+			c.Log.Error().Msgf("Error reading moderation audit log: %v", err)
+			RespondWithError(w, &JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: map[string]any{
+					"errcode": "M_UNKNOWN",
+					"error":   "Couldn't read audit log.",
+				},
+			})
+			return
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"audit": entries,
+			},
+		})
+	}
+}
+
+var ErrModerationUsage = errors.New(`usage:
+  commune hide <events|users|rooms> <target> [reason]
+  commune unhide <events|users|rooms> <target> [reason]
+  commune hidden <events|users|rooms>
+  commune audit`)
+
+// RunModerationCommand runs the local moderation CLI commands.
+func (c *App) RunModerationCommand(args []string, actor string) error {
+	if len(args) == 0 {
+		return ErrModerationUsage
+	}
+
+	reason := ""
+	if len(args) > 3 {
+		reason = args[3]
+	}
+
+	switch args[0] {
+	case "hide", "unhide":
+		if len(args) < 3 || !IsHiddenKind(args[1]) || !validHiddenTarget(args[1], args[2]) {
+			return ErrModerationUsage
+		}
+		if args[0] == "hide" {
+			return c.Hide(args[1], args[2], reason, actor)
+		}
+		found, err := c.Unhide(args[1], args[2], reason, actor)
+		if err == nil && !found {
+			return fmt.Errorf("%s is not hidden", args[2])
+		}
+		return err
+
+	case "hidden":
+		if len(args) < 2 || !IsHiddenKind(args[1]) {
+			return ErrModerationUsage
+		}
+		entries, err := c.Hidden(args[1])
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			fmt.Printf("%s\t%s\t%s\t%s\n", entry.Target,
+				time.UnixMilli(entry.TS).Format(time.RFC3339), entry.Actor, entry.Reason)
+		}
+		return nil
+
+	case "audit":
+		entries, err := c.AuditLog(100)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\t%s\n", time.UnixMilli(entry.TS).Format(time.RFC3339),
+				entry.Actor, entry.Action, entry.Kind, entry.Target, entry.Reason)
+		}
+		return nil
+	}
+
+	return ErrModerationUsage
+}
@@ -0,0 +1,800 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+//go:embed templates
+var templateFS embed.FS
+
+// pages that are rendered within the layout
+var pageNames = []string{"room", "space", "event", "error"}
+
+// longest description put in a page's meta tags
+const maxPageDescription = 300
+
+// NewTemplates parses the page templates. They're embedded, so a parse
+// error is a bug and panics.
+func (c *App) NewTemplates() map[string]*template.Template {
+	funcs := template.FuncMap{
+		"media": c.MediaURL,
+		"thumbnail": func(mxc string, size int) string {
+			return c.ThumbnailURL(mxc, size, size)
+		},
+		"matrixto": func(room string) string {
+			return fmt.Sprintf("https://matrix.to/#/%s", room)
+		},
+	}
+
+	base := template.Must(template.New("").Funcs(funcs).ParseFS(templateFS,
+		"templates/layout.html",
+		"templates/partials.html",
+	))
+
+	pages := map[string]*template.Template{}
+	for _, name := range pageNames {
+		t := template.Must(base.Clone())
+		pages[name] = template.Must(t.ParseFS(templateFS, "templates/"+name+".html"))
+	}
+
+	return pages
+}
+
+// Page holds everything the templates render. Pages only fill in the parts
+// they use.
+type Page struct {
+	Title       string
+	Description string
+	Canonical   string
+	NoIndex     bool
+
+	// the room's name and page
+	Name string
+	Path string
+
+	// the page its feeds are under, if it has any
+	Feed string
+
+	Room     *RoomInfo
+	Parents  []*PageRoom
+	Children []*PageRoom
+
+	Events []*PageEvent
+	Event  *PageEvent
+	Older  string
+	Newer  string
+	Notice string
+
+	Status int
+
+	Meta PageMeta
+}
+
+// PageMeta is what link previews are made from, as OpenGraph and Twitter
+// card tags and schema.org JSON-LD.
+type PageMeta struct {
+	SiteName    string
+	Type        string
+	Card        string
+	Image       string
+	ImageWidth  int
+	ImageHeight int
+	ImageAlt    string
+	Published   time.Time
+	LinkedData  any
+}
+
+type PageRoom struct {
+	RoomID    string
+	Name      string
+	Topic     string
+	AvatarURL string
+	Members   int
+	Space     bool
+	Path      string
+}
+
+// PageEvent is a timeline event reduced to what the templates show.
+type PageEvent struct {
+	EventID    string
+	Sender     string
+	SenderName string
+	Time       time.Time
+	Path       string
+	Kind       string
+	Body       template.HTML
+	Text       string
+	URL        string
+	Filename   string
+	Hidden     int
+}
+
+// pathSegment escapes an ID for a page path. The sigils room IDs start with
+// are allowed in paths, so they're left readable.
+func pathSegment(s string) string {
+	return strings.ReplaceAll(url.PathEscape(s), "%21", "!")
+}
+
+func RoomPagePath(room_id string) string {
+	return "/view/room/" + pathSegment(room_id)
+}
+
+func SpacePagePath(room_id string) string {
+	return "/view/space/" + pathSegment(room_id)
+}
+
+func EventPagePath(room_id, event_id string) string {
+	return RoomPagePath(room_id) + "/event/" + pathSegment(event_id)
+}
+
+// PageTimelineLimit returns how many events are read for each page of a
+// room's timeline.
+func (c *App) PageTimelineLimit() int {
+	if c.Config.Pages.TimelineLimit > 0 {
+		return min(c.Config.Pages.TimelineLimit, 100)
+	}
+	return 50
+}
+
+// RenderPage writes a page with the layout. Pages never run scripts, and
+// only load images from this service.
+func (c *App) RenderPage(w http.ResponseWriter, name string, page *Page) {
+	status := page.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	var buf bytes.Buffer
+	err := c.Templates[name].ExecuteTemplate(&buf, "layout", page)
+	if err != nil {
+		c.Log.Error().Msgf("Error rendering %s page: %v", name, err)
+		http.Error(w, "Error rendering page", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", fmt.Sprintf("default-src 'none'; img-src 'self' %s; style-src 'unsafe-inline'", c.PublicURL()))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if status == http.StatusOK {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+	}
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+func (c *App) RenderErrorPage(w http.ResponseWriter, status int, message string) {
+	c.RenderPage(w, "error", &Page{
+		Title:   message,
+		Notice:  message,
+		NoIndex: true,
+		Status:  status,
+	})
+}
+
+// ResolveRoomID turns a room ID, or the localpart of an alias on the local
+// server, into a room ID.
+func (c *App) ResolveRoomID(room string) (id.RoomID, error) {
+	if IsValidRoomID(room) {
+		return id.RoomID(room), nil
+	}
+
+	alias := id.NewRoomAlias(strings.TrimPrefix(room, "#"), c.Config.Matrix.ServerName)
+	if strings.HasPrefix(room, "#") && strings.Contains(room, ":") {
+		alias = id.RoomAlias(room)
+	}
+
+	resp, err := c.Matrix.ResolveAlias(context.Background(), alias)
+	if err != nil {
+		return "", err
+	}
+	return resp.RoomID, nil
+}
+
+// pageRoom resolves the page's room and renders a not found page if it
+// isn't exposed. Rooms that aren't exposed look the same as rooms that
+// don't exist.
+func (c *App) pageRoom(w http.ResponseWriter, r *http.Request) (id.RoomID, bool) {
+	param, err := url.PathUnescape(chi.URLParam(r, "room_id"))
+	if err != nil {
+		c.RenderErrorPage(w, http.StatusNotFound, "Room not found")
+		return "", false
+	}
+
+	room_id, err := c.ResolveRoomID(param)
+	if err != nil || c.RoomExposure(room_id) != nil {
+		c.RenderErrorPage(w, http.StatusNotFound, "Room not found")
+		return "", false
+	}
+
+	return room_id, true
+}
+
+// NewPage starts a page for a resolved room, with its info, link preview
+// and the public spaces it belongs to. It also returns the room's entry in
+// the public rooms list, which is nil if it isn't listed.
+func (c *App) NewPage(resolved *ResolvedRoomInfo) (*Page, *PublicRoom) {
+	info := resolved.Info
+	room_id := id.RoomID(info.RoomID)
+
+	page := &Page{
+		Title:       RoomTitle(info),
+		Description: Truncate(info.Topic, maxPageDescription),
+		Name:        RoomTitle(info),
+		Path:        RoomPagePath(room_id.String()),
+		Room:        info,
+	}
+
+	c.SetRoomMeta(page, info)
+
+	rooms, err := c.ListPublicRooms()
+	if err != nil {
+		c.Log.Error().Msgf("Error listing public rooms: %v", err)
+		return page, nil
+	}
+
+	listed := make(map[string]*PublicRoom, len(rooms))
+	for i := range rooms {
+		listed[rooms[i].RoomID] = &rooms[i]
+	}
+
+	entry := listed[room_id.String()]
+	if entry == nil {
+		return page, nil
+	}
+
+	if entry.Type == "m.space" {
+		page.Path = SpacePagePath(room_id.String())
+	}
+
+	for _, parent := range entry.Parents {
+		if room, ok := listed[parent]; ok {
+			page.Parents = append(page.Parents, NewPageRoom(room))
+		}
+	}
+
+	for _, child := range entry.SpaceChildren {
+		if room, ok := listed[child.RoomID]; ok {
+			page.Children = append(page.Children, NewPageRoom(room))
+		}
+	}
+
+	return page, entry
+}
+
+// resolvePage resolves a page's room, and the event if one is given, and
+// renders an error page if that fails.
+func (c *App) resolvePage(w http.ResponseWriter, o *RoomInfoOptions) (*ResolvedRoomInfo, bool) {
+	resolved, err := c.ResolveRoomInfo(o)
+	if err != nil {
+		c.Log.Error().Msgf("Error fetching room info: %v", err)
+		c.RenderErrorPage(w, http.StatusBadGateway, "Couldn't load this room")
+		return nil, false
+	}
+	return resolved, true
+}
+
+// SiteName is shown in link previews as where the page is from.
+func (c *App) SiteName() string {
+	if c.Config.Pages.SiteName != "" {
+		return c.Config.Pages.SiteName
+	}
+	return c.Config.App.Domain
+}
+
+// SetRoomMeta fills in a room page's link preview. A banner is shown as it
+// is, otherwise the room's generated card is.
+func (c *App) SetRoomMeta(page *Page, info *RoomInfo) {
+	page.Meta = PageMeta{
+		SiteName: c.SiteName(),
+		Type:     "website",
+		Card:     "summary_large_image",
+		ImageAlt: page.Name,
+	}
+
+	if info.BannerURL != "" {
+		page.Meta.Image = c.MediaURL(info.BannerURL)
+		if info.BannerInfo != nil {
+			page.Meta.ImageWidth, page.Meta.ImageHeight = info.BannerInfo.Width, info.BannerInfo.Height
+		}
+	} else {
+		page.Meta.Image = c.PublicURL() + RoomCardPath(info.RoomID)
+		page.Meta.ImageWidth, page.Meta.ImageHeight = CardWidth, CardHeight
+	}
+}
+
+// SetEventMeta turns a page's link preview into one for a single event.
+// Images posted in the event take the place of the room's, and other
+// events get a card of their own.
+func (c *App) SetEventMeta(page *Page, ev *PageEvent) {
+	page.Meta.Type = "article"
+	page.Meta.Published = ev.Time
+
+	if ev.Kind == "image" {
+		page.Meta.Card = "summary_large_image"
+		page.Meta.Image = c.ThumbnailURL(ev.URL, 800, 800)
+		page.Meta.ImageWidth, page.Meta.ImageHeight = 0, 0
+		page.Meta.ImageAlt = ev.Text
+	} else {
+		page.Meta.Card = "summary_large_image"
+		page.Meta.Image = c.PublicURL() + EventCardPath(page.Room.RoomID, ev.EventID)
+		page.Meta.ImageWidth, page.Meta.ImageHeight = CardWidth, CardHeight
+	}
+
+	posting := map[string]any{
+		"@context":      "https://schema.org",
+		"@type":         "DiscussionForumPosting",
+		"headline":      Truncate(ev.Text, 110),
+		"url":           page.Canonical,
+		"datePublished": ev.Time.Format(time.RFC3339),
+		"author":        PersonLinkedData(ev),
+		"isPartOf": map[string]any{
+			"@type": "WebPage",
+			"name":  page.Name,
+			"url":   c.PublicURL() + page.Path,
+		},
+	}
+	if ev.Text != "" {
+		posting["text"] = ev.Text
+	}
+	if ev.Kind == "image" {
+		posting["image"] = page.Meta.Image
+	}
+
+	page.Meta.LinkedData = posting
+}
+
+// RoomLinkedData describes a room page as a discussion, with the messages
+// on the page as its comments.
+func (c *App) RoomLinkedData(page *Page) map[string]any {
+	posting := map[string]any{
+		"@context": "https://schema.org",
+		"@type":    "DiscussionForumPosting",
+		"headline": page.Name,
+		"url":      page.Canonical,
+	}
+	if page.Description != "" {
+		posting["text"] = page.Description
+	}
+	if page.Meta.Image != "" {
+		posting["image"] = page.Meta.Image
+	}
+
+	comments := []map[string]any{}
+	for _, ev := range page.Events {
+		if ev.Kind == "gap" {
+			continue
+		}
+		comment := map[string]any{
+			"@type":         "Comment",
+			"url":           c.PublicURL() + ev.Path,
+			"datePublished": ev.Time.Format(time.RFC3339),
+			"author":        PersonLinkedData(ev),
+		}
+		if ev.Text != "" {
+			comment["text"] = ev.Text
+		}
+		comments = append(comments, comment)
+	}
+	if len(comments) > 0 {
+		posting["comment"] = comments
+	}
+
+	return posting
+}
+
+func PersonLinkedData(ev *PageEvent) map[string]any {
+	return map[string]any{
+		"@type":      "Person",
+		"name":       ev.Author(),
+		"identifier": ev.Sender,
+	}
+}
+
+// Author is the sender's display name if it's known, or their user ID.
+func (ev *PageEvent) Author() string {
+	if ev.SenderName != "" {
+		return ev.SenderName
+	}
+	return ev.Sender
+}
+
+func NewPageRoom(room *PublicRoom) *PageRoom {
+	p := &PageRoom{
+		RoomID:    room.RoomID,
+		Name:      room.Name,
+		Topic:     room.Topic,
+		AvatarURL: room.AvatarURL,
+		Members:   room.NumJoinedMembers,
+		Space:     room.Type == "m.space",
+		Path:      RoomPagePath(room.RoomID),
+	}
+	if p.Name == "" {
+		p.Name = room.CanonicalAlias
+	}
+	if p.Name == "" {
+		p.Name = room.RoomID
+	}
+	if p.Space {
+		p.Path = SpacePagePath(room.RoomID)
+	}
+	return p
+}
+
+func RoomTitle(info *RoomInfo) string {
+	if info.Name != "" {
+		return info.Name
+	}
+	if info.CanonicalAlias != "" {
+		return info.CanonicalAlias
+	}
+	return info.RoomID
+}
+
+// Truncate shortens s to at most n runes, on a word boundary if there's one
+// nearby.
+func Truncate(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+
+	cut := string(runes[:n-1])
+	if i := strings.LastIndex(cut, " "); i > len(cut)/2 {
+		cut = cut[:i]
+	}
+	return cut + "…"
+}
+
+// RoomTimeline reads a page of a room's timeline, newest first, and filters
+// it like the /messages proxy does. The first page comes from the messages
+// cache when there is one.
+func (c *App) RoomTimeline(room_id id.RoomID, from string) ([]map[string]any, string, error) {
+	ctx := context.Background()
+
+	var body []byte
+
+	if from == "" && c.Config.Cache.Messages.Enabled {
+		cached, err := c.Cache.Messages.Get(ctx, room_id.String()).Result()
+		if err == nil && cached != "" {
+			body = []byte(cached)
+		}
+	}
+
+	if body == nil {
+		messages, err := c.Matrix.Messages(ctx, room_id, from, "", mautrix.DirectionBackward, nil, c.PageTimelineLimit())
+		if err != nil {
+			return nil, "", err
+		}
+		body, err = json.Marshal(messages)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	filtered, _, err := c.FilterTimelineResponse(room_id, body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var resp struct {
+		Chunk []map[string]any `json:"chunk"`
+		End   string           `json:"end"`
+	}
+	if err := DecodeJSON(filtered, &resp); err != nil {
+		return nil, "", err
+	}
+
+	sanitizer := c.Sanitizer()
+
+	events := make([]map[string]any, 0, len(resp.Chunk))
+	for _, ev := range resp.Chunk {
+		if sanitizer.SanitizeEvent(ev) {
+			events = append(events, ev)
+		}
+	}
+
+	return events, resp.End, nil
+}
+
+// NewPageEvent prepares a timeline event for the templates. Events that
+// pages don't show, such as state events, return nil.
+func (c *App) NewPageEvent(room_id string, ev map[string]any) *PageEvent {
+	event_type, _ := ev["type"].(string)
+	event_id, _ := ev["event_id"].(string)
+	sender, _ := ev["sender"].(string)
+	content, _ := ev["content"].(map[string]any)
+
+	pe := &PageEvent{
+		EventID: event_id,
+		Sender:  sender,
+		Time:    time.UnixMilli(EventTimestamp(ev)).UTC(),
+		Path:    EventPagePath(room_id, event_id),
+	}
+
+	body, _ := content["body"].(string)
+	pe.Text = body
+
+	switch event_type {
+	case "commune.gap":
+		pe.Kind = "gap"
+		switch count := content["count"].(type) {
+		case int:
+			pe.Hidden = count
+		case json.Number:
+			n, _ := count.Int64()
+			pe.Hidden = int(n)
+		}
+		return pe
+
+	case "m.sticker":
+		pe.Kind = "image"
+		pe.URL, _ = content["url"].(string)
+
+	case "m.room.message":
+		msgtype, _ := content["msgtype"].(string)
+
+		switch msgtype {
+		case "m.text", "m.notice", "m.emote":
+			pe.Kind = strings.TrimPrefix(msgtype, "m.")
+			pe.Text = StripReplyFallback(content, body)
+			pe.Body = c.MessageHTML(content, pe.Text)
+			return pe
+		case "m.image", "m.video", "m.audio", "m.file":
+			pe.Kind = strings.TrimPrefix(msgtype, "m.")
+			pe.URL, _ = content["url"].(string)
+			pe.Filename, _ = content["filename"].(string)
+			if pe.Filename == "" {
+				pe.Filename = body
+			}
+		default:
+			return nil
+		}
+
+	default:
+		return nil
+	}
+
+	// encrypted attachments have no url, and can't be shown
+	if _, _, ok := ParseMXC(pe.URL); !ok {
+		return nil
+	}
+
+	return pe
+}
+
+// MessageHTML renders a message body, from its sanitized formatted body if
+// it has one.
+func (c *App) MessageHTML(content map[string]any, body string) template.HTML {
+	format, _ := content["format"].(string)
+	formatted, _ := content["formatted_body"].(string)
+
+	if format == "org.matrix.custom.html" && formatted != "" {
+		return template.HTML(SanitizeMatrixHTML(formatted, c.MediaURL))
+	}
+
+	return template.HTML(strings.ReplaceAll(html.EscapeString(body), "\n", "<br>"))
+}
+
+// StripReplyFallback removes the quoted lines that replies start with in
+// their plain body.
+func StripReplyFallback(content map[string]any, body string) string {
+	relates, _ := content["m.relates_to"].(map[string]any)
+	if _, ok := relates["m.in_reply_to"]; !ok {
+		return body
+	}
+
+	lines := strings.Split(body, "\n")
+	i := 0
+	for i < len(lines) && strings.HasPrefix(lines[i], ">") {
+		i++
+	}
+	if i == 0 {
+		return body
+	}
+	for i < len(lines) && lines[i] == "" {
+		i++
+	}
+	return strings.Join(lines[i:], "\n")
+}
+
+// RoomPage shows a room's info and a page of its recent timeline, oldest
+// first, with links to older pages.
+func (c *App) RoomPage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		room_id, ok := c.pageRoom(w, r)
+		if !ok {
+			return
+		}
+
+		resolved, ok := c.resolvePage(w, &RoomInfoOptions{
+			RoomID: room_id.String(),
+		})
+		if !ok {
+			return
+		}
+
+		page, entry := c.NewPage(resolved)
+
+		if entry != nil && entry.Type == "m.space" {
+			http.Redirect(w, r, SpacePagePath(room_id.String()), http.StatusMovedPermanently)
+			return
+		}
+
+		page.Canonical = c.PublicURL() + RoomPagePath(room_id.String())
+
+		from := r.URL.Query().Get("from")
+
+		// homeserver tokens make poor canonical pages
+		if from != "" {
+			page.NoIndex = true
+			page.Newer = RoomPagePath(room_id.String())
+		}
+
+		endpoints, err := c.RoomEndpoints(room_id)
+		if err != nil || !endpoints.Allows("messages") || c.EndpointDisabled(room_id, "messages") {
+			page.Notice = "This room's messages aren't public."
+			c.RenderPage(w, "room", page)
+			return
+		}
+
+		events, end, err := c.RoomTimeline(room_id, from)
+		if err != nil {
+			c.Log.Error().Msgf("Error fetching room timeline: %v", err)
+			c.RenderErrorPage(w, http.StatusBadGateway, "Couldn't load this room's messages")
+			return
+		}
+
+		for i := len(events) - 1; i >= 0; i-- {
+			if pe := c.NewPageEvent(room_id.String(), events[i]); pe != nil {
+				page.Events = append(page.Events, pe)
+			}
+		}
+
+		if end != "" && len(events) > 0 {
+			page.Older = RoomPagePath(room_id.String()) + "?from=" + url.QueryEscape(end)
+		}
+
+		page.Feed = RoomPagePath(room_id.String())
+		page.Meta.LinkedData = c.RoomLinkedData(page)
+
+		c.RenderPage(w, "room", page)
+	}
+}
+
+// SpacePage shows a space's info and its public children. Like /info, it
+// takes a child room, by slug or room ID, and an event in that room as the
+// room and event query parameters, and sends them to the child's pages.
+func (c *App) SpacePage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		room_id, ok := c.pageRoom(w, r)
+		if !ok {
+			return
+		}
+
+		resolved, ok := c.resolvePage(w, &RoomInfoOptions{
+			RoomID:      room_id.String(),
+			ChildRoomID: r.URL.Query().Get("room"),
+			EventID:     r.URL.Query().Get("event"),
+		})
+		if !ok {
+			return
+		}
+
+		if child := resolved.Room; child != nil && c.RoomExposure(id.RoomID(child.RoomID)) == nil {
+			event_id, _ := resolved.Event["event_id"].(string)
+			if event_id != "" {
+				http.Redirect(w, r, EventPagePath(child.RoomID, event_id), http.StatusFound)
+				return
+			}
+			http.Redirect(w, r, RoomPagePath(child.RoomID), http.StatusFound)
+			return
+		}
+
+		page, entry := c.NewPage(resolved)
+
+		if entry == nil || entry.Type != "m.space" {
+			http.Redirect(w, r, RoomPagePath(room_id.String()), http.StatusMovedPermanently)
+			return
+		}
+
+		page.Canonical = c.PublicURL() + SpacePagePath(room_id.String())
+		page.Feed = SpacePagePath(room_id.String())
+
+		c.RenderPage(w, "space", page)
+	}
+}
+
+// EventPage shows a single event, if it may be shown at all.
+func (c *App) EventPage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		room_id, ok := c.pageRoom(w, r)
+		if !ok {
+			return
+		}
+
+		if c.EndpointDisabled(room_id, "event") {
+			c.RenderErrorPage(w, http.StatusNotFound, "Message not found")
+			return
+		}
+		endpoints, err := c.RoomEndpoints(room_id)
+		if err != nil || !endpoints.Allows("messages") {
+			c.RenderErrorPage(w, http.StatusNotFound, "Message not found")
+			return
+		}
+
+		event_id, err := url.PathUnescape(chi.URLParam(r, "event_id"))
+		if err != nil {
+			c.RenderErrorPage(w, http.StatusNotFound, "Message not found")
+			return
+		}
+
+		resolved, ok := c.resolvePage(w, &RoomInfoOptions{
+			RoomID:  room_id.String(),
+			EventID: event_id,
+		})
+		if !ok {
+			return
+		}
+
+		var ev *PageEvent
+		if resolved.Event != nil {
+			ev = c.NewPageEvent(room_id.String(), resolved.Event)
+		}
+		if ev == nil {
+			c.RenderErrorPage(w, http.StatusNotFound, "Message not found")
+			return
+		}
+		if resolved.Sender != nil {
+			ev.SenderName = resolved.Sender.DisplayName
+		}
+
+		page, _ := c.NewPage(resolved)
+
+		page.Event = ev
+		page.Canonical = c.PublicURL() + ev.Path
+		page.Title = fmt.Sprintf("%s in %s", ev.Author(), page.Title)
+		if ev.Text != "" {
+			page.Description = Truncate(ev.Text, maxPageDescription)
+		}
+
+		c.SetEventMeta(page, ev)
+
+		c.RenderPage(w, "event", page)
+	}
+}
+
+// RobotsRules returns the paths crawlers are allowed and disallowed. Without
+// any configured, only pages and the media they show may be crawled, and
+// only if pages are enabled.
+func (c *App) RobotsRules() (allow []string, disallow []string) {
+	allow, disallow = c.Config.Robots.Allow, c.Config.Robots.Disallow
+
+	if len(allow) == 0 && len(disallow) == 0 {
+		disallow = []string{"/"}
+		if c.Config.Pages.Enabled {
+			allow = []string{"/view/", "/_matrix/client/v1/media/", "/sitemap"}
+		}
+	}
+
+	return allow, disallow
+}
@@ -0,0 +1,234 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// kinds of policy rule, keyed by the event types that carry them, including
+// the older unstable ones still sent by some moderation bots
+var policyRuleKinds = map[string]string{
+	"m.policy.rule.user":             "user",
+	"m.policy.rule.room":             "room",
+	"m.policy.rule.server":           "server",
+	"m.room.rule.user":               "user",
+	"m.room.rule.room":               "room",
+	"m.room.rule.server":             "server",
+	"org.matrix.mjolnir.rule.user":   "user",
+	"org.matrix.mjolnir.rule.room":   "room",
+	"org.matrix.mjolnir.rule.server": "server",
+}
+
+// PolicyRuleKind returns whether an event type is a policy rule, and which
+// kind of entity it applies to.
+func PolicyRuleKind(event_type string) (string, bool) {
+	kind, ok := policyRuleKinds[event_type]
+	return kind, ok
+}
+
+// PolicyRule is a single recommendation from a policy list.
+type PolicyRule struct {
+	Entity         string
+	Recommendation string
+	Reason         string
+	pattern        *regexp.Regexp
+}
+
+func (r *PolicyRule) IsBan() bool {
+	return r.Recommendation == "m.ban" || r.Recommendation == "org.matrix.mjolnir.ban"
+}
+
+// PolicyLists holds the rules of the policy list rooms the appservice
+// follows. Methods are safe to call on a nil *PolicyLists, which has no
+// rules.
+type PolicyLists struct {
+	mu    sync.RWMutex
+	lists map[id.RoomID]bool
+	// kind -> list room, event type and state key -> rule
+	rules map[string]map[string]*PolicyRule
+}
+
+func NewPolicyLists() *PolicyLists {
+	return &PolicyLists{
+		lists: map[id.RoomID]bool{},
+		rules: map[string]map[string]*PolicyRule{},
+	}
+}
+
+// IsList reports whether a room is a followed policy list.
+func (p *PolicyLists) IsList(room_id id.RoomID) bool {
+	if p == nil {
+		return false
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.lists[room_id]
+}
+
+func (p *PolicyLists) AddList(room_id id.RoomID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lists[room_id] = true
+}
+
+// SetRule adds, replaces or removes a rule from a policy rule state event.
+// Rules without an entity, such as the empty content policy bots send to
+// remove a rule, remove whatever rule was there before.
+func (p *PolicyLists) SetRule(list id.RoomID, event_type, state_key string, content map[string]any) {
+	kind, ok := PolicyRuleKind(event_type)
+	if !ok {
+		return
+	}
+
+	key := fmt.Sprintf("%s|%s|%s", list, event_type, state_key)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.rules[kind] == nil {
+		p.rules[kind] = map[string]*PolicyRule{}
+	}
+
+	entity, _ := content["entity"].(string)
+	if entity == "" {
+		delete(p.rules[kind], key)
+		return
+	}
+
+	recommendation, _ := content["recommendation"].(string)
+	reason, _ := content["reason"].(string)
+
+	p.rules[kind][key] = &PolicyRule{
+		Entity:         entity,
+		Recommendation: recommendation,
+		Reason:         reason,
+		pattern:        GlobPattern(entity),
+	}
+}
+
+// Match returns the first ban rule of a kind that matches an entity.
+func (p *PolicyLists) Match(kind, entity string) *PolicyRule {
+	if p == nil || entity == "" {
+		return nil
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, rule := range p.rules[kind] {
+		if rule.IsBan() && rule.pattern.MatchString(entity) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// BannedUser returns the rule banning a user, either directly or through
+// their server.
+func (p *PolicyLists) BannedUser(user_id string) *PolicyRule {
+	if rule := p.Match("user", user_id); rule != nil {
+		return rule
+	}
+	return p.Match("server", GetDomain(user_id))
+}
+
+// BannedRoom returns the rule banning a room, either directly or through the
+// server in its ID.
+func (p *PolicyLists) BannedRoom(room_id string) *PolicyRule {
+	if rule := p.Match("room", room_id); rule != nil {
+		return rule
+	}
+	return p.Match("server", GetDomain(room_id))
+}
+
+// GlobPattern compiles a Matrix glob, where * matches any number of
+// characters and ? matches exactly one.
+func GlobPattern(glob string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// LoadPolicyLists joins the configured policy list rooms and reads their
+// rules. Aliases are resolved to room IDs first.
+func (c *App) LoadPolicyLists() {
+	ctx := context.Background()
+
+	for _, list := range c.Config.Policy.Lists {
+
+		room_id := id.RoomID(list)
+
+		if strings.HasPrefix(list, "#") {
+			resp, err := c.Matrix.ResolveAlias(ctx, id.RoomAlias(list))
+			if err != nil {
+				c.Log.Error().Msgf("Couldn't resolve policy list %v: %v", list, err)
+				continue
+			}
+			room_id = resp.RoomID
+		}
+
+		c.Policy.AddList(room_id)
+
+		_, err := c.Matrix.JoinRoom(ctx, room_id.String(), "", nil)
+		if err != nil {
+			c.Log.Error().Msgf("Couldn't join policy list %v: %v", list, err)
+			continue
+		}
+
+		state, err := c.Matrix.State(ctx, room_id)
+		if err != nil {
+			c.Log.Error().Msgf("Couldn't fetch policy list %v: %v", list, err)
+			continue
+		}
+
+		count := 0
+		for evt, events := range state {
+			if _, ok := PolicyRuleKind(evt.Type); !ok {
+				continue
+			}
+			for state_key, ev := range events {
+				c.Policy.SetRule(room_id, evt.Type, state_key, ev.Content.Raw)
+				count++
+			}
+		}
+
+		c.Log.Info().Msgf("Loaded %d rules from policy list %v", count, list)
+	}
+
+	// pages cached before a restart were filtered against the old rules
+	if len(c.Config.Policy.Lists) > 0 {
+		c.ClearMessagesCache()
+	}
+}
+
+// AllowsJoin applies the policy lists to a room we've been invited to or
+// would join automatically.
+func (c *App) AllowsJoin(room_id id.RoomID, inviter id.UserID) bool {
+	if rule := c.Policy.BannedRoom(room_id.String()); rule != nil {
+		c.Log.Info().Msgf("Not joining %v, banned by policy list: %v", room_id, rule.Entity)
+		return false
+	}
+	if inviter != "" {
+		if rule := c.Policy.BannedUser(inviter.String()); rule != nil {
+			c.Log.Info().Msgf("Not joining %v, inviter banned by policy list: %v", room_id, rule.Entity)
+			return false
+		}
+	}
+	return true
+}
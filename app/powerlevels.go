@@ -0,0 +1,68 @@
+package app
+
+import (
+	"encoding/json"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func numberValue(v any) (int, bool) {
+	switch n := v.(type) {
+	case float64:
+		return int(n), true
+	case json.Number:
+		i, err := n.Int64()
+		return int(i), err == nil
+	}
+	return 0, false
+}
+
+// UserPowerLevel returns a user's power level in a room. Without a
+// m.room.power_levels event, only the room creator has any power.
+func UserPowerLevel(state mautrix.RoomStateMap, user_id id.UserID) int {
+	pl := state[event.StatePowerLevels][""]
+	if pl == nil {
+		create := state[event.StateCreate][""]
+		if create != nil && create.Sender == user_id {
+			return 100
+		}
+		return 0
+	}
+
+	if users, ok := pl.Content.Raw["users"].(map[string]any); ok {
+		if level, ok := numberValue(users[user_id.String()]); ok {
+			return level
+		}
+	}
+
+	level, _ := numberValue(pl.Content.Raw["users_default"])
+	return level
+}
+
+// RequiredStateLevel returns the power level needed to send a state event.
+func RequiredStateLevel(state mautrix.RoomStateMap, evt event.Type) int {
+	pl := state[event.StatePowerLevels][""]
+	if pl == nil {
+		return 0
+	}
+
+	if events, ok := pl.Content.Raw["events"].(map[string]any); ok {
+		if level, ok := numberValue(events[evt.Type]); ok {
+			return level
+		}
+	}
+
+	if level, ok := numberValue(pl.Content.Raw["state_default"]); ok {
+		return level
+	}
+
+	return 50
+}
+
+// CanSendState reports whether a user has enough power to send a state event
+// of the given type.
+func CanSendState(state mautrix.RoomStateMap, user_id id.UserID, evt event.Type) bool {
+	return UserPowerLevel(state, user_id) >= RequiredStateLevel(state, evt)
+}
@@ -0,0 +1,248 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"maunium.net/go/mautrix/id"
+)
+
+// Member privacy modes. Full passes member events through, anonymous strips
+// display names and avatars, and counts hides members apart from how many
+// there are.
+const (
+	MemberPrivacyFull      = "full"
+	MemberPrivacyAnonymous = "anonymous"
+	MemberPrivacyCounts    = "counts"
+)
+
+// MemberPrivacy returns the member privacy mode for a room, with per-room
+// configuration taking precedence.
+func (c *App) MemberPrivacy(room_id id.RoomID) string {
+	privacy := c.Config.Exposure.MemberPrivacy
+
+	for _, room := range c.Config.Exposure.Rooms {
+		if room.RoomID == room_id.String() && room.MemberPrivacy != "" {
+			privacy = room.MemberPrivacy
+		}
+	}
+
+	switch privacy {
+	case MemberPrivacyAnonymous, MemberPrivacyCounts:
+		return privacy
+	}
+	return MemberPrivacyFull
+}
+
+// EndpointDisabled reports whether configuration turns off a proxied
+// endpoint, either globally or for the room.
+func (c *App) EndpointDisabled(room_id id.RoomID, endpoint string) bool {
+	if Contains(c.Config.Exposure.DisabledEndpoints, endpoint) {
+		return true
+	}
+
+	for _, room := range c.Config.Exposure.Rooms {
+		if room.RoomID == room_id.String() && Contains(room.DisabledEndpoints, endpoint) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func IsMemberEvent(ev map[string]any) bool {
+	t, _ := ev["type"].(string)
+	return t == "m.room.member"
+}
+
+// AnonymizeMember strips the profile from a member event's content.
+func AnonymizeMember(ev map[string]any) {
+	if content, ok := ev["content"].(map[string]any); ok {
+		AnonymizeMemberContent(content)
+	}
+	if unsigned, ok := ev["unsigned"].(map[string]any); ok {
+		if prev, ok := unsigned["prev_content"].(map[string]any); ok {
+			AnonymizeMemberContent(prev)
+		}
+	}
+}
+
+func AnonymizeMemberContent(content map[string]any) {
+	delete(content, "displayname")
+	delete(content, "avatar_url")
+}
+
+// Redact applies the room's member privacy to an event that's being shown,
+// and filters the events bundled with it.
+func (f *EventFilter) Redact(ev map[string]any) {
+	if f.MemberPrivacy == MemberPrivacyAnonymous && IsMemberEvent(ev) {
+		AnonymizeMember(ev)
+	}
+	f.FilterAggregations(ev)
+}
+
+// FilterAggregations checks the events the homeserver bundles with an event,
+// like the latest reply in a thread, which are full events of their own.
+// Aggregations whose event can't be shown are dropped.
+func (f *EventFilter) FilterAggregations(ev map[string]any) {
+	unsigned, ok := ev["unsigned"].(map[string]any)
+	if !ok {
+		return
+	}
+	relations, ok := unsigned["m.relations"].(map[string]any)
+	if !ok {
+		return
+	}
+
+	for rel_type, v := range relations {
+		aggregation, ok := v.(map[string]any)
+		if !ok {
+			continue
+		}
+		latest, ok := aggregation["latest_event"].(map[string]any)
+		if !ok {
+			continue
+		}
+		if !f.Visible(latest) {
+			delete(relations, rel_type)
+			continue
+		}
+		f.Redact(latest)
+	}
+
+	if len(relations) == 0 {
+		delete(unsigned, "m.relations")
+	}
+}
+
+// FilterStateEvents applies member privacy to a list of state events. Member
+// events are dropped entirely when only counts are exposed.
+func FilterStateEvents(f *EventFilter, events []map[string]any) []map[string]any {
+	filtered := make([]map[string]any, 0, len(events))
+	for _, ev := range events {
+		if f.MemberPrivacy == MemberPrivacyCounts && IsMemberEvent(ev) {
+			continue
+		}
+		f.Redact(ev)
+		filtered = append(filtered, ev)
+	}
+	return filtered
+}
+
+// RewriteState is the rewriter for /state, which returns a bare list of state
+// events.
+func (c *App) RewriteState(r *http.Request, body []byte) ([]byte, int, error) {
+	room_id := id.RoomID(chi.URLParam(r, "room_id"))
+
+	f := &EventFilter{
+		RoomID:        room_id,
+		MemberPrivacy: c.MemberPrivacy(room_id),
+	}
+
+	var events []map[string]any
+	if err := DecodeJSON(body, &events); err != nil {
+		return nil, 0, err
+	}
+
+	b, err := json.Marshal(FilterStateEvents(f, events))
+	return b, http.StatusOK, err
+}
+
+// RewriteStateEvent is the rewriter for /state/{eventType}/{stateKey}, which
+// returns just the content of a state event.
+func (c *App) RewriteStateEvent(r *http.Request, body []byte) ([]byte, int, error) {
+	room_id := id.RoomID(chi.URLParam(r, "room_id"))
+
+	if !strings.Contains(r.URL.Path, "/state/m.room.member") {
+		return body, http.StatusOK, nil
+	}
+
+	switch c.MemberPrivacy(room_id) {
+	case MemberPrivacyCounts:
+		return NotFoundResponse("Event not found.")
+	case MemberPrivacyAnonymous:
+		var content map[string]any
+		if err := DecodeJSON(body, &content); err != nil {
+			return nil, 0, err
+		}
+		AnonymizeMemberContent(content)
+		b, err := json.Marshal(content)
+		return b, http.StatusOK, err
+	}
+
+	return body, http.StatusOK, nil
+}
+
+// RewriteMembers is the rewriter for /members.
+func (c *App) RewriteMembers(r *http.Request, body []byte) ([]byte, int, error) {
+	room_id := id.RoomID(chi.URLParam(r, "room_id"))
+
+	privacy := c.MemberPrivacy(room_id)
+	if privacy == MemberPrivacyFull {
+		return body, http.StatusOK, nil
+	}
+
+	var resp struct {
+		Chunk []map[string]any `json:"chunk"`
+	}
+	if err := DecodeJSON(body, &resp); err != nil {
+		return nil, 0, err
+	}
+
+	if privacy == MemberPrivacyCounts {
+		counts := map[string]int{}
+		for _, ev := range resp.Chunk {
+			content, _ := ev["content"].(map[string]any)
+			membership, _ := content["membership"].(string)
+			if membership != "" {
+				counts[membership]++
+			}
+		}
+		b, err := json.Marshal(map[string]any{
+			"chunk":  []any{},
+			"counts": counts,
+		})
+		return b, http.StatusOK, err
+	}
+
+	for _, ev := range resp.Chunk {
+		AnonymizeMember(ev)
+	}
+
+	b, err := json.Marshal(resp)
+	return b, http.StatusOK, err
+}
+
+// RewriteJoinedMembers is the rewriter for /joined_members.
+func (c *App) RewriteJoinedMembers(r *http.Request, body []byte) ([]byte, int, error) {
+	room_id := id.RoomID(chi.URLParam(r, "room_id"))
+
+	privacy := c.MemberPrivacy(room_id)
+	if privacy == MemberPrivacyFull {
+		return body, http.StatusOK, nil
+	}
+
+	var resp struct {
+		Joined map[string]map[string]any `json:"joined"`
+	}
+	if err := DecodeJSON(body, &resp); err != nil {
+		return nil, 0, err
+	}
+
+	if privacy == MemberPrivacyCounts {
+		b, err := json.Marshal(map[string]any{
+			"joined": map[string]any{},
+			"count":  len(resp.Joined),
+		})
+		return b, http.StatusOK, err
+	}
+
+	for user := range resp.Joined {
+		resp.Joined[user] = map[string]any{}
+	}
+
+	b, err := json.Marshal(resp)
+	return b, http.StatusOK, err
+}
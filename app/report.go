@@ -0,0 +1,330 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+const reportsKey = "reports"
+
+// how many reports are kept
+const maxReports = 10000
+
+// longest reason that's accepted
+const maxReportReason = 1000
+
+// Report is an anonymous report of an event in an exposed room. Reporters
+// are only identified by a hash of their address, for rate limiting.
+type Report struct {
+	RoomID    string `json:"room_id"`
+	EventID   string `json:"event_id"`
+	Sender    string `json:"sender"`
+	Reason    string `json:"reason"`
+	Permalink string `json:"permalink"`
+	Reporter  string `json:"reporter"`
+	TS        int64  `json:"ts"`
+}
+
+func Permalink(room_id id.RoomID, event_id id.EventID) string {
+	return fmt.Sprintf("https://matrix.to/#/%s/%s", room_id, event_id)
+}
+
+// ReportRateLimit returns how many reports one address may send per hour.
+func (c *App) ReportRateLimit() int64 {
+	if c.Config.Reports.RateLimit > 0 {
+		return c.Config.Reports.RateLimit
+	}
+	return 5
+}
+
+func addrHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// TrustedProxy reports whether an address belongs to one of the configured
+// reverse proxies, given as IPs or CIDR ranges.
+func (c *App) TrustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, proxy := range c.Config.Reports.TrustedProxies {
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if trusted := net.ParseIP(proxy); trusted != nil && trusted.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reporterHash identifies a reporter by the address the request came from.
+// The forwarded address is only used when the request came through a trusted
+// proxy, as anyone else could send a new one with every report.
+func (c *App) reporterHash(r *http.Request) string {
+	host := addrHost(PeerAddr(r))
+	if c.TrustedProxy(host) {
+		host = addrHost(r.RemoteAddr)
+	}
+	sum := sha256.Sum256([]byte(host))
+	return hex.EncodeToString(sum[:8])
+}
+
+// AllowReport counts a report against the reporter's hourly limit, and
+// returns how long until they may report again if they're over it.
+func (c *App) AllowReport(reporter string) (bool, time.Duration, error) {
+	ctx := context.Background()
+	key := fmt.Sprintf("report_rate:%s", reporter)
+
+	count, err := c.Cache.Rooms.Incr(ctx, key).Result()
+	if err != nil {
+		return false, 0, err
+	}
+
+	if count == 1 {
+		c.Cache.Rooms.Expire(ctx, key, time.Hour)
+	}
+
+	if count > c.ReportRateLimit() {
+		ttl, err := c.Cache.Rooms.TTL(ctx, key).Result()
+		if err != nil || ttl < 0 {
+			ttl = time.Hour
+		}
+		return false, ttl, nil
+	}
+
+	return true, 0, nil
+}
+
+func (c *App) RecordReport(report *Report) error {
+	ctx := context.Background()
+
+	b, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	err = c.Cache.Rooms.LPush(ctx, reportsKey, b).Err()
+	if err != nil {
+		return err
+	}
+
+	return c.Cache.Rooms.LTrim(ctx, reportsKey, 0, maxReports-1).Err()
+}
+
+// ForwardReport passes a report on to the homeserver's report API, as the
+// appservice user.
+func (c *App) ForwardReport(report *Report) error {
+	_, err := c.Matrix.MakeFullRequest(context.Background(), mautrix.FullRequest{
+		Method: http.MethodPost,
+		URL:    c.Matrix.BuildClientURL("v3", "rooms", report.RoomID, "report", report.EventID),
+		RequestJSON: map[string]any{
+			"reason": report.Reason,
+		},
+	})
+	return err
+}
+
+// NotifyModerators posts a notice about a report in the moderation room.
+func (c *App) NotifyModerators(report *Report) error {
+	text := fmt.Sprintf("Anonymous report of an event by %s in %s\n%s\nReason: %s",
+		report.Sender, report.RoomID, report.Permalink, report.Reason)
+
+	_, err := c.Matrix.SendNotice(context.Background(), id.RoomID(c.Config.Reports.ModerationRoom), text)
+	return err
+}
+
+func (c *App) ReportEvent() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		room_id := id.RoomID(chi.URLParam(r, "room_id"))
+		event_id := id.EventID(chi.URLParam(r, "event_id"))
+
+		var req struct {
+			Reason string `json:"reason"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			RespondWithError(w, &JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: map[string]any{
+					"errcode": "M_NOT_JSON",
+					"error":   "Request body must be JSON.",
+				},
+			})
+			return
+		}
+
+		req.Reason = strings.TrimSpace(req.Reason)
+
+		if req.Reason == "" || len(req.Reason) > maxReportReason {
+			RespondWithError(w, &JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: map[string]any{
+					"errcode": "M_INVALID_PARAM",
+					"error":   fmt.Sprintf("A reason of up to %d characters is required.", maxReportReason),
+				},
+			})
+			return
+		}
+
+		reporter := c.reporterHash(r)
+
+		// reports aren't accepted when they can't be counted, so an outage
+		// can't be used to flood moderators
+		allowed, retry, err := c.AllowReport(reporter)
+		if err != nil {
+			c.Log.Error().Msgf("Error checking report rate limit: %v", err)
+			RespondWithError(w, &JSONResponse{
+				Code: http.StatusServiceUnavailable,
+				JSON: map[string]any{
+					"errcode": "M_UNKNOWN",
+					"error":   "Reports can't be accepted right now.",
+				},
+			})
+			return
+		}
+
+		if !allowed {
+			RespondWithError(w, &JSONResponse{
+				Code: http.StatusTooManyRequests,
+				JSON: map[string]any{
+					"errcode":        "M_LIMIT_EXCEEDED",
+					"error":          "Too many reports.",
+					"retry_after_ms": retry.Milliseconds(),
+				},
+			})
+			return
+		}
+
+		// only events that anonymous users can see may be reported
+		ev, err := c.Matrix.GetEvent(context.Background(), room_id, event_id)
+		if err != nil {
+			RespondWithError(w, &JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: map[string]any{
+					"errcode": "M_NOT_FOUND",
+					"error":   "Event not found.",
+				},
+			})
+			return
+		}
+
+		f, err := c.NewEventFilter(room_id)
+		if err != nil {
+			c.Log.Error().Msgf("Error building event filter: %v", err)
+		}
+
+		b, _ := json.Marshal(ev)
+		var visible map[string]any
+		DecodeJSON(b, &visible)
+
+		if f == nil || !f.Visible(visible) {
+			RespondWithError(w, &JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: map[string]any{
+					"errcode": "M_NOT_FOUND",
+					"error":   "Event not found.",
+				},
+			})
+			return
+		}
+
+		report := &Report{
+			RoomID:    room_id.String(),
+			EventID:   event_id.String(),
+			Sender:    ev.Sender.String(),
+			Reason:    req.Reason,
+			Permalink: Permalink(room_id, event_id),
+			Reporter:  reporter,
+			TS:        time.Now().UnixMilli(),
+		}
+
+		err = c.RecordReport(report)
+		if err != nil {
+			c.Log.Error().Msgf("Error recording report: %v", err)
+			RespondWithError(w, &JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: map[string]any{
+					"errcode": "M_UNKNOWN",
+					"error":   "Couldn't record report.",
+				},
+			})
+			return
+		}
+
+		c.Log.Info().Msgf("Event %v in %v reported", event_id, room_id)
+
+		go func() {
+			if c.Config.Reports.ForwardToHomeserver {
+				if err := c.ForwardReport(report); err != nil {
+					c.Log.Error().Msgf("Error forwarding report to homeserver: %v", err)
+				}
+			}
+			if c.Config.Reports.ModerationRoom != "" {
+				if err := c.NotifyModerators(report); err != nil {
+					c.Log.Error().Msgf("Error notifying moderation room: %v", err)
+				}
+			}
+		}()
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{},
+		})
+	}
+}
+
+func (c *App) ListReports() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		values, err := c.Cache.Rooms.LRange(context.Background(), reportsKey, 0, 99).Result()
+		if err != nil {
+			c.Log.Error().Msgf("Error reading reports: %v", err)
+			RespondWithError(w, &JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: map[string]any{
+					"errcode": "M_UNKNOWN",
+					"error":   "Couldn't read reports.",
+				},
+			})
+			return
+		}
+
+		reports := make([]Report, 0, len(values))
+		for _, value := range values {
+			var report Report
+			if err := json.Unmarshal([]byte(value), &report); err == nil {
+				reports = append(reports, report)
+			}
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"reports": reports,
+			},
+		})
+	}
+}
@@ -76,8 +76,19 @@ func RespondWithBadRequestError(w http.ResponseWriter) {
 func (c *App) RobotsTXT() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
+		allow, disallow := c.RobotsRules()
+
 		w.Header().Set("Content-Type", "text/plain")
 		fmt.Fprintln(w, "User-agent: *")
-		fmt.Fprintln(w, "Disallow: /")
+		for _, path := range allow {
+			fmt.Fprintf(w, "Allow: %s\n", path)
+		}
+		for _, path := range disallow {
+			fmt.Fprintf(w, "Disallow: %s\n", path)
+		}
+
+		if c.Config.Pages.Enabled {
+			fmt.Fprintf(w, "\nSitemap: %s/sitemap.xml\n", c.PublicURL())
+		}
 	}
 }
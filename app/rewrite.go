@@ -0,0 +1,405 @@
+package app
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"maunium.net/go/mautrix/id"
+)
+
+// keys in proxied responses that hold lists of timeline events
+var timelineKeys = []string{"chunk", "events_before", "events_after"}
+
+// DecodeJSON decodes without turning numbers into floats, so that large
+// integers in event content survive being re-encoded.
+func DecodeJSON(b []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+const GapEventType = "commune.gap"
+
+// GapMarker stands in for a run of hidden events, so clients can tell that
+// something was left out without seeing what it was. Its ID is derived from
+// the hidden events' IDs, and the dot keeps it from ever matching a real
+// one. It has no timestamp of its own, see FilterEvents.
+func GapMarker(room_id id.RoomID, hidden []map[string]any) map[string]any {
+	h := sha256.New()
+	for _, ev := range hidden {
+		event_id, _ := ev["event_id"].(string)
+		io.WriteString(h, event_id+"\n")
+	}
+
+	return map[string]any{
+		"type":     GapEventType,
+		"room_id":  room_id.String(),
+		"event_id": "$" + GapEventType + "." + hex.EncodeToString(h.Sum(nil)[:16]),
+		"content": map[string]any{
+			"count": len(hidden),
+		},
+	}
+}
+
+// IsGapMarker tells the service's own gap markers apart from events of the
+// same type sent to a room, which can't have IDs like these.
+func IsGapMarker(ev map[string]any) bool {
+	event_type, _ := ev["type"].(string)
+	event_id, _ := ev["event_id"].(string)
+	return event_type == GapEventType && strings.HasPrefix(event_id, "$"+GapEventType+".")
+}
+
+// FilterEvents replaces events that aren't visible with gap markers.
+// Consecutive hidden events share a single marker, which takes the timestamp
+// of an event next to it, so it only gives away where the hidden events were.
+func FilterEvents(f *EventFilter, events []map[string]any) []map[string]any {
+	filtered := make([]map[string]any, 0, len(events))
+	hidden := []map[string]any{}
+	markers := []int{}
+
+	gap := func() {
+		if len(hidden) > 0 {
+			markers = append(markers, len(filtered))
+			filtered = append(filtered, GapMarker(f.RoomID, hidden))
+			hidden = []map[string]any{}
+		}
+	}
+
+	for _, ev := range events {
+		if f.Visible(ev) {
+			gap()
+			f.Redact(ev)
+			filtered = append(filtered, ev)
+			continue
+		}
+		hidden = append(hidden, ev)
+	}
+	gap()
+
+	for _, i := range markers {
+		if i > 0 {
+			filtered[i]["origin_server_ts"] = filtered[i-1]["origin_server_ts"]
+		} else if len(filtered) > 1 {
+			filtered[i]["origin_server_ts"] = filtered[1]["origin_server_ts"]
+		}
+	}
+
+	return filtered
+}
+
+// FilterTimelineResponse filters the events in a /messages, /context,
+// /event, /relations or /threads response body. It returns ok as false if
+// the response is a single event that must not be shown at all.
+func (c *App) FilterTimelineResponse(room_id id.RoomID, body []byte) (filtered []byte, ok bool, err error) {
+
+	var resp map[string]json.RawMessage
+	if err := DecodeJSON(body, &resp); err != nil {
+		return nil, false, err
+	}
+
+	f, err := c.NewEventFilter(room_id)
+	if err != nil {
+		return nil, false, err
+	}
+
+	lists := map[string][]map[string]any{}
+	all := []map[string]any{}
+
+	for _, key := range timelineKeys {
+		raw, exists := resp[key]
+		if !exists {
+			continue
+		}
+		var events []map[string]any
+		if err := DecodeJSON(raw, &events); err != nil {
+			return nil, false, err
+		}
+		lists[key] = events
+		all = append(all, events...)
+	}
+
+	var state []map[string]any
+	if raw, exists := resp["state"]; exists {
+		if err := DecodeJSON(raw, &state); err != nil {
+			return nil, false, err
+		}
+	}
+
+	var single map[string]any
+	if raw, exists := resp["event"]; exists {
+		if err := DecodeJSON(raw, &single); err != nil {
+			return nil, false, err
+		}
+		all = append(all, single)
+	}
+
+	// a bare event, as returned by /event/{eventId}
+	_, has_id := resp["event_id"]
+	_, has_type := resp["type"]
+	is_event := has_id && has_type
+	if is_event {
+		if err := DecodeJSON(body, &single); err != nil {
+			return nil, false, err
+		}
+		all = append(all, single)
+	}
+
+	c.ObserveVisibility(f, all)
+
+	// media in events that are shown may be served through the media proxy
+	for _, ev := range all {
+		c.IndexEventMedia(f, ev)
+	}
+
+	if is_event {
+		if !f.Visible(single) {
+			return nil, false, nil
+		}
+		f.Redact(single)
+		filtered, err = json.Marshal(single)
+		return filtered, err == nil, err
+	}
+
+	for key, events := range lists {
+		b, err := json.Marshal(FilterEvents(f, events))
+		if err != nil {
+			return nil, false, err
+		}
+		resp[key] = b
+	}
+
+	if state != nil {
+		b, err := json.Marshal(FilterStateEvents(f, state))
+		if err != nil {
+			return nil, false, err
+		}
+		resp["state"] = b
+	}
+
+	if single != nil {
+		if f.Visible(single) {
+			f.Redact(single)
+		} else {
+			single = GapMarker(room_id, []map[string]any{single})
+		}
+		b, err := json.Marshal(single)
+		if err != nil {
+			return nil, false, err
+		}
+		resp["event"] = b
+	}
+
+	filtered, err = json.Marshal(resp)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return filtered, true, nil
+}
+
+// ResponseRewriter rewrites the body of a successful JSON response from the
+// homeserver, and may change its status code.
+type ResponseRewriter func(r *http.Request, body []byte) ([]byte, int, error)
+
+// NotFoundResponse replaces a response that must not be shown at all.
+func NotFoundResponse(msg string) ([]byte, int, error) {
+	b, err := json.Marshal(map[string]any{
+		"errcode": "M_NOT_FOUND",
+		"error":   msg,
+	})
+	return b, http.StatusNotFound, err
+}
+
+// RewriteTimeline is the rewriter for room timeline responses.
+func (c *App) RewriteTimeline(r *http.Request, body []byte) ([]byte, int, error) {
+	room_id := chi.URLParam(r, "room_id")
+
+	filtered, ok, err := c.FilterTimelineResponse(id.RoomID(room_id), body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if !ok {
+		return NotFoundResponse("Event not found.")
+	}
+
+	return filtered, http.StatusOK, nil
+}
+
+// NewRewritingProxy returns a reverse proxy to the homeserver that passes
+// successful JSON responses through a rewriter and the sanitizer before
+// they're returned.
+func (c *App) NewRewritingProxy(rewrite ResponseRewriter) *httputil.ReverseProxy {
+
+	endpoint := fmt.Sprintf("%s/", c.Config.Matrix.Homeserver)
+	target, _ := url.Parse(endpoint)
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		// we need to read the body, so ask for it uncompressed
+		r.Header.Del("Accept-Encoding")
+	}
+
+	proxy.ModifyResponse = func(resp *http.Response) error {
+
+		if resp.StatusCode != http.StatusOK ||
+			!strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+			return nil
+		}
+
+		if rewrite == nil {
+			return c.SanitizeResponse(resp, resp.Body)
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		rewritten, status, err := rewrite(resp.Request, body)
+		if err != nil {
+			return err
+		}
+
+		if status != http.StatusOK {
+			resp.StatusCode = status
+			SetResponseBody(resp, rewritten)
+			return nil
+		}
+
+		return c.SanitizeResponse(resp, io.NopCloser(bytes.NewReader(rewritten)))
+	}
+
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		c.Log.Error().Msgf("Error rewriting proxied response: %v", err)
+		RespondWithError(w, &JSONResponse{
+			Code: http.StatusBadGateway,
+			JSON: map[string]any{
+				"errcode": "M_UNKNOWN",
+				"error":   "Error fetching from homeserver.",
+			},
+		})
+	}
+
+	return proxy
+}
+
+func SetResponseBody(resp *http.Response, body []byte) {
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// SanitizeResponse replaces the response body with a sanitized copy of body.
+// Single events and state event content are small, so they're handled in
+// full, everything else is sanitized as it streams to the client.
+func (c *App) SanitizeResponse(resp *http.Response, body io.ReadCloser) error {
+
+	sanitizer := c.Sanitizer()
+	path := resp.Request.URL.Path
+
+	_, after_state, is_state := strings.Cut(path, "/state/")
+	is_event := strings.Contains(path, "/event/")
+
+	if is_event || (is_state && after_state != "") {
+		b, err := io.ReadAll(body)
+		body.Close()
+		if err != nil {
+			return err
+		}
+
+		var v map[string]any
+		if err := DecodeJSON(b, &v); err != nil {
+			return err
+		}
+
+		allowed := false
+		if is_event {
+			allowed = sanitizer.SanitizeEvent(v)
+		} else {
+			event_type, _, _ := strings.Cut(after_state, "/")
+			allowed = sanitizer.SanitizeContent(event_type, v)
+		}
+
+		if !allowed {
+			b, status, err := NotFoundResponse("Event not found.")
+			if err != nil {
+				return err
+			}
+			resp.StatusCode = status
+			SetResponseBody(resp, b)
+			return nil
+		}
+
+		var buf bytes.Buffer
+		if err := writeJSON(&buf, v); err != nil {
+			return err
+		}
+		SetResponseBody(resp, buf.Bytes())
+		return nil
+	}
+
+	// /state returns a bare list of events
+	root := ""
+	if strings.HasSuffix(path, "/state") {
+		root = "state"
+	}
+
+	pr, pw := io.Pipe()
+
+	go func() {
+		err := sanitizer.Stream(pw, body, root)
+		body.Close()
+		if err != nil {
+			c.Log.Error().Msgf("Error sanitizing response: %v", err)
+		}
+		pw.CloseWithError(err)
+	}()
+
+	resp.Body = pr
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+
+	return nil
+}
+
+// NewFilteringProxy returns a reverse proxy to the homeserver that filters
+// room timeline responses before they're passed on.
+func (c *App) NewFilteringProxy() *httputil.ReverseProxy {
+	return c.NewRewritingProxy(c.RewriteTimeline)
+}
+
+// RewritingProxy is like MatrixAPIProxy, but passes responses through a
+// rewriter. Responses are always sanitized, so a nil rewriter only does that.
+func (c *App) RewritingProxy(rewrite ResponseRewriter) http.HandlerFunc {
+
+	proxy := c.NewRewritingProxy(rewrite)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.Config.AppService.AccessToken))
+		w.Header().Del("Access-Control-Allow-Origin")
+
+		proxy.ServeHTTP(w, r)
+	}
+}
+
+// TimelineProxy is like MatrixAPIProxy, but hides events that weren't
+// public at the time they were sent.
+func (c *App) TimelineProxy() http.HandlerFunc {
+	return c.RewritingProxy(c.RewriteTimeline)
+}
@@ -0,0 +1,233 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// how long computing a room's image info may take, downloads included
+const imageInfoTimeout = 2 * time.Minute
+
+// ImageInfo describes a room avatar or banner, so clients can reserve space
+// and show a placeholder while it loads. It keeps the URL it describes, so
+// it's never attached to a changed image.
+type ImageInfo struct {
+	URL      string `json:"url"`
+	Blurhash string `json:"blurhash,omitempty"`
+	Width    int    `json:"w,omitempty"`
+	Height   int    `json:"h,omitempty"`
+}
+
+// OriginalMedia fetches the original of an image through the media cache.
+func (c *App) OriginalMedia(ctx context.Context, mxc string) (*CachedMedia, error) {
+	server, media_id, ok := ParseMXC(mxc)
+	if !ok {
+		return nil, fmt.Errorf("invalid mxc URI: %s", mxc)
+	}
+
+	original := &MediaRequest{
+		Server:  server,
+		MediaID: media_id,
+	}
+	key := original.CacheKey() + "/original"
+
+	src, err := c.MediaCache().Get(key)
+	if err != nil {
+		src, err = c.fetchOriginalImage(ctx, original, key)
+	}
+	return src, err
+}
+
+// OriginalImage fetches and decodes the original of an image. The decoding
+// waits for an image slot, which is held until release is called.
+func (c *App) OriginalImage(ctx context.Context, mxc string) (img image.Image, release func(), err error) {
+	src, err := c.OriginalMedia(ctx, mxc)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer src.Close()
+
+	acquireImageSlot()
+
+	img, err = c.ImagePipeline().Decode(src.File, src.Meta.ContentType)
+	if err != nil {
+		releaseImageSlot()
+		return nil, nil, err
+	}
+
+	return img, releaseImageSlot, nil
+}
+
+// ComputeImageInfo measures an image and computes its blurhash.
+func (c *App) ComputeImageInfo(ctx context.Context, mxc string) (*ImageInfo, error) {
+	img, release, err := c.OriginalImage(ctx, mxc)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	b := img.Bounds()
+
+	x_components, y_components := 4, 3
+	if b.Dy() > b.Dx() {
+		x_components, y_components = 3, 4
+	}
+
+	hash, err := EncodeBlurhash(ScaleImage(img, 32, 32), x_components, y_components)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ImageInfo{
+		URL:      mxc,
+		Blurhash: hash,
+		Width:    b.Dx(),
+		Height:   b.Dy(),
+	}, nil
+}
+
+// CachedRoomInfo reads the room info stored by AddRoomToCache.
+func (c *App) CachedRoomInfo(room_id string) *RoomInfo {
+	cached, err := c.Cache.Rooms.Get(context.Background(), room_id).Result()
+	if err != nil || cached == "" {
+		return nil
+	}
+
+	var info RoomInfo
+	if err := json.Unmarshal([]byte(cached), &info); err != nil {
+		return nil
+	}
+	return &info
+}
+
+// AttachRoomImages sets the avatar and banner info of a room from what's
+// stored with it, as long as its images haven't changed. Missing info is
+// filled in later by UpdateRoomImages.
+func (c *App) AttachRoomImages(info *RoomInfo) {
+	cached := c.CachedRoomInfo(info.RoomID)
+	if cached == nil {
+		info.AvatarInfo, info.BannerInfo = nil, nil
+		return
+	}
+
+	info.AvatarInfo = reuseImageInfo(info.AvatarURL, cached.AvatarInfo)
+	info.BannerInfo = reuseImageInfo(info.BannerURL, cached.BannerInfo)
+}
+
+func reuseImageInfo(url string, previous *ImageInfo) *ImageInfo {
+	if url == "" || previous == nil || previous.URL != url {
+		return nil
+	}
+	return previous
+}
+
+// UpdateRoomImages computes any avatar and banner info missing from a room's
+// cache entry in the background, so that transactions aren't held up by
+// downloads, and stores it once it's ready.
+func (c *App) UpdateRoomImages(room_id string) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), imageInfoTimeout)
+		defer cancel()
+
+		info := c.CachedRoomInfo(room_id)
+		if info == nil {
+			return
+		}
+
+		compute := func(url string, previous *ImageInfo) *ImageInfo {
+			if url == "" || previous != nil {
+				return nil
+			}
+			image, err := c.ComputeImageInfo(ctx, url)
+			if err != nil {
+				c.Log.Info().Msgf("Couldn't compute image info for %v: %v", url, err)
+				return nil
+			}
+			return image
+		}
+
+		avatar := compute(info.AvatarURL, info.AvatarInfo)
+		banner := compute(info.BannerURL, info.BannerInfo)
+		if avatar == nil && banner == nil {
+			return
+		}
+
+		// the room may have changed while the images were computed
+		info = c.CachedRoomInfo(room_id)
+		if info == nil {
+			return
+		}
+		if avatar != nil && avatar.URL == info.AvatarURL {
+			info.AvatarInfo = avatar
+		}
+		if banner != nil && banner.URL == info.BannerURL {
+			info.BannerInfo = banner
+		}
+
+		c.AddRoomToCache(info)
+	}()
+}
+
+// RefreshRoomImages updates the room cache after a room's avatar or banner
+// changes. The new image's info follows once it's computed.
+func (c *App) RefreshRoomImages(room_id id.RoomID) error {
+	info, err := c.GetRoomInfo(&RoomInfoOptions{
+		RoomID: room_id.String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	c.AttachRoomImages(info)
+
+	if err := c.AddRoomToCache(info); err != nil {
+		return err
+	}
+
+	c.UpdateRoomImages(info.RoomID)
+
+	return nil
+}
+
+// AttachPublicRoomImages copies avatar and banner info from the room cache
+// into a public rooms listing.
+func (c *App) AttachPublicRoomImages(rooms []PublicRoom) {
+	if len(rooms) == 0 {
+		return
+	}
+
+	room_ids := make([]string, 0, len(rooms))
+	for _, room := range rooms {
+		room_ids = append(room_ids, room.RoomID)
+	}
+
+	values, err := c.Cache.Rooms.MGet(context.Background(), room_ids...).Result()
+	if err != nil {
+		c.Log.Error().Msgf("Error fetching room images: %v", err)
+		return
+	}
+
+	for i, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			continue
+		}
+
+		var info RoomInfo
+		if err := json.Unmarshal([]byte(s), &info); err != nil {
+			continue
+		}
+
+		if info.AvatarInfo != nil && info.AvatarInfo.URL == rooms[i].AvatarURL {
+			rooms[i].AvatarInfo = info.AvatarInfo
+		}
+		if info.BannerInfo != nil && info.BannerInfo.URL == rooms[i].BannerURL {
+			rooms[i].BannerInfo = info.BannerInfo
+		}
+	}
+}
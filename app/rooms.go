@@ -3,8 +3,9 @@ package app
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"net/http"
+	"slices"
 	"strings"
 
 	"github.com/go-chi/chi/v5"
@@ -14,24 +15,31 @@ import (
 )
 
 type PublicRoom struct {
-	RoomID            string   `json:"room_id"`
-	Type              string   `json:"type,omitempty"`
-	OriginServerTS    int64    `json:"origin_server_ts"`
-	RoomType          string   `json:"room_type,omitempty"`
-	Name              string   `json:"name,omitempty"`
-	CanonicalAlias    string   `json:"canonical_alias"`
-	CommuneAlias      string   `json:"commune_alias,omitempty"`
-	Sender            string   `json:"sender,omitempty"`
-	AvatarURL         string   `json:"avatar_url,omitempty"`
-	BannerURL         string   `json:"banner_url,omitempty"`
-	Topic             string   `json:"topic,omitempty"`
-	JoinRule          string   `json:"join_rule"`
-	HistoryVisibility string   `json:"history_visibility"`
-	Children          []string `json:"children,omitempty"`
-	Parents           []string `json:"parents,omitempty"`
-	Settings          any      `json:"settings,omitempty"`
-	RoomCategories    any      `json:"room_categories,omitempty"`
-	IsBridge          bool     `json:"is_bridge"`
+	RoomID            string       `json:"room_id"`
+	Type              string       `json:"type,omitempty"`
+	OriginServerTS    int64        `json:"origin_server_ts"`
+	RoomType          string       `json:"room_type,omitempty"`
+	Name              string       `json:"name,omitempty"`
+	CanonicalAlias    string       `json:"canonical_alias"`
+	CommuneAlias      string       `json:"commune_alias,omitempty"`
+	Sender            string       `json:"sender,omitempty"`
+	AvatarURL         string       `json:"avatar_url,omitempty"`
+	BannerURL         string       `json:"banner_url,omitempty"`
+	AvatarInfo        *ImageInfo   `json:"avatar_info,omitempty"`
+	BannerInfo        *ImageInfo   `json:"banner_info,omitempty"`
+	Topic             string       `json:"topic,omitempty"`
+	JoinRule          string       `json:"join_rule"`
+	HistoryVisibility string       `json:"history_visibility"`
+	GuestCanJoin      bool         `json:"guest_can_join"`
+	Children          []string     `json:"children,omitempty"`
+	SpaceChildren     []SpaceChild `json:"space_children,omitempty"`
+	Parents           []string     `json:"parents,omitempty"`
+	Settings          any          `json:"settings,omitempty"`
+	RoomCategories    any          `json:"room_categories,omitempty"`
+	IsBridge          bool         `json:"is_bridge"`
+	NumJoinedMembers  int          `json:"num_joined_members"`
+	LastActivityTS    int64        `json:"last_activity_ts,omitempty"`
+	MessageCount      int64        `json:"message_count"`
 }
 
 type Rooms struct {
@@ -46,28 +54,19 @@ type PublicRooms struct {
 func (c *App) PublicRooms() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		if c.Config.Cache.PublicRooms.Enabled {
-
-			cached, err := c.Cache.Rooms.Get(context.Background(), "public_rooms").Result()
-
-			if err == nil && cached != "" {
-				c.Log.Info().Msgf("Found cached public rooms")
-
-				var data map[string]interface{}
-
-				if err := json.Unmarshal([]byte(cached), &data); err == nil {
-					RespondWithJSON(w, &JSONResponse{
-						Code: http.StatusOK,
-						JSON: data,
-					})
-					return
-				}
-
-			}
-
+		query, err := ParsePublicRoomsQuery(r.URL.Query())
+		if err != nil {
+			RespondWithError(w, &JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: map[string]any{
+					"errcode": "M_INVALID_PARAM",
+					"error":   err.Error(),
+				},
+			})
+			return
 		}
 
-		public_rooms, err := c.GetPublicRooms()
+		public_rooms, err := c.ListPublicRooms()
 		if err != nil {
 			RespondWithJSON(w, &JSONResponse{
 				Code: http.StatusOK,
@@ -79,77 +78,125 @@ func (c *App) PublicRooms() http.HandlerFunc {
 			return
 		}
 
-		if c.Config.Cache.PublicRooms.Enabled {
-			go func() {
-				c.Log.Info().Msgf("Caching public rooms")
-				err := c.CachePublicRooms(public_rooms)
-				if err != nil {
-					c.Log.Error().Msgf("Couldn't marshal public rooms %v", err)
-				}
-			}()
+		page, err := QueryPublicRooms(public_rooms, query)
+		if err != nil {
+			RespondWithError(w, &JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: map[string]any{
+					"errcode": "M_INVALID_PARAM",
+					"error":   err.Error(),
+				},
+			})
+			return
+		}
+
+		resp := map[string]any{
+			"rooms": page.Rooms,
+			"total": page.Total,
+		}
+
+		if page.NextBatch != "" {
+			resp["next_batch"] = page.NextBatch
+		}
+
+		if page.PrevBatch != "" {
+			resp["prev_batch"] = page.PrevBatch
 		}
 
 		RespondWithJSON(w, &JSONResponse{
 			Code: http.StatusOK,
-			JSON: map[string]any{
-				"rooms": public_rooms,
-			},
+			JSON: resp,
 		})
 	}
 }
 
-func (c *App) GetPublicRooms() (any, error) {
+// ListPublicRooms returns the processed public rooms, from the cache when
+// it's enabled and populated, otherwise straight from the homeserver.
+func (c *App) ListPublicRooms() ([]PublicRoom, error) {
 
-	rooms, err := c.Matrix.JoinedRooms(context.Background())
-	if err != nil {
-		return nil, err
-	}
+	if c.Config.Cache.PublicRooms.Enabled {
 
-	parents := []*PublicRooms{}
+		cached, err := c.Cache.Rooms.Get(context.Background(), "public_rooms").Result()
 
-	if len(rooms.JoinedRooms) > 0 {
+		if err == nil && cached != "" {
+			c.Log.Info().Msgf("Found cached public rooms")
 
-		for _, room_id := range rooms.JoinedRooms {
+			var rooms []PublicRoom
 
-			state, err := c.Matrix.State(context.Background(), room_id)
-			if err != nil {
-				c.Log.Error().Msgf("Error fetching state: %v", err)
+			if err := json.Unmarshal([]byte(cached), &rooms); err == nil {
+				c.AttachRoomActivity(rooms)
+				c.AttachPublicRoomImages(rooms)
+				return c.FilterHiddenRooms(rooms), nil
 			}
+		}
+	}
 
-			has_children := event.NewEventType("m.space.child")
-			has_parent := event.NewEventType("m.space.parent")
+	public_rooms, err := c.GetPublicRooms()
 
-			is_parent_space := len(state[has_children]) > 0
-			is_child_space := len(state[has_parent]) > 0
+	// partial results are served, but not cached
+	var partial *PartialFetchError
+	if errors.As(err, &partial) {
+		c.Log.Warn().Msgf("Serving partial public rooms: %v", err)
+	} else if err != nil {
+		return nil, err
+	}
 
-			if !is_parent_space || is_child_space {
-				//continue
+	if c.Config.Cache.PublicRooms.Enabled && partial == nil {
+		go func() {
+			c.Log.Info().Msgf("Caching public rooms")
+			err := c.CachePublicRooms(public_rooms)
+			if err != nil {
+				c.Log.Error().Msgf("Couldn't marshal public rooms %v", err)
 			}
+		}()
+	}
 
-			parent := PublicRooms{
-				RoomID: room_id,
-				State:  state,
-			}
+	// activity and images are always read fresh, so they're kept out of the
+	// cached copy
+	rooms := slices.Clone(public_rooms)
+	c.AttachRoomActivity(rooms)
+	c.AttachPublicRoomImages(rooms)
 
-			parents = append(parents, &parent)
-		}
+	return c.FilterHiddenRooms(rooms), nil
+}
+
+// GetPublicRooms fetches and processes the state of every joined room. If
+// some rooms fail, the rest are still returned along with a
+// *PartialFetchError.
+func (c *App) GetPublicRooms() ([]PublicRoom, error) {
 
+	rooms, err := c.Matrix.JoinedRooms(context.Background())
+	if err != nil {
+		return nil, err
 	}
 
-	if len(parents) > 0 {
+	if len(rooms.JoinedRooms) == 0 {
+		return nil, nil
+	}
 
-		rms, err := ProcessPublicRooms(parents)
-		if err != nil {
-			c.Log.Error().Msgf("Error processing public rooms: %v", err)
-		}
-		return rms, nil
+	fetched := c.FetchRoomStates(context.Background(), rooms.JoinedRooms)
+
+	if len(fetched.States) == 0 {
+		return nil, fetched.Err()
+	}
+
+	rms, err := ProcessPublicRooms(c.EligibleRooms(fetched.States))
+	if err != nil {
+		c.Log.Error().Msgf("Error processing public rooms: %v", err)
 	}
 
-	return nil, nil
+	return rms, fetched.Err()
 }
 
 func ProcessPublicRooms(rooms []*PublicRooms) ([]PublicRoom, error) {
 	processed := []PublicRoom{}
+
+	// space children and parents are only listed if we know about them
+	known := make(map[string]bool, len(rooms))
+	for _, room := range rooms {
+		known[room.RoomID.String()] = true
+	}
+
 	for _, room := range rooms {
 
 		r := PublicRoom{
@@ -159,34 +206,16 @@ func ProcessPublicRooms(rooms []*PublicRooms) ([]PublicRoom, error) {
 		bridge := CouldBeBridge(room.State)
 		r.IsBridge = bridge
 
-		child_state := room.State[event.NewEventType("m.space.child")]
-		if child_state != nil {
-			for child, ev := range child_state {
-
-				// don't list child spaces with empty content
-				via := ev.Content.Raw["via"]
-				if via == nil {
-					continue
-				}
+		r.NumJoinedMembers = JoinedMemberCount(room.State)
+		r.LastActivityTS = LatestStateTimestamp(room.State)
 
-				for _, ro := range rooms {
-					join_rule_event := ro.State[event.NewEventType("m.room.join_rules")][""]
-					if join_rule_event != nil {
-						join_rule, ok := join_rule_event.Content.Raw["join_rule"].(string)
-						if ok {
-							if join_rule != "public" {
-								//continue
-							}
-							if ro.RoomID.String() == child {
-								r.Children = append(r.Children, child)
-							}
-						}
-					}
-				}
-
-			}
+		r.SpaceChildren = SpaceChildren(room.State, known)
+		for _, child := range r.SpaceChildren {
+			r.Children = append(r.Children, child.RoomID)
 		}
 
+		r.Parents = SpaceParents(room.State, known)
+
 		room_type_event := room.State[event.NewEventType("m.room.create")][""]
 		if room_type_event != nil {
 			room_type, ok := room_type_event.Content.Raw["type"].(string)
@@ -251,6 +280,14 @@ func ProcessPublicRooms(rooms []*PublicRooms) ([]PublicRoom, error) {
 			}
 		}
 
+		guest_event := room.State[event.StateGuestAccess][""]
+		if guest_event != nil {
+			access, ok := guest_event.Content.Raw["guest_access"].(string)
+			if ok {
+				r.GuestCanJoin = access == "can_join"
+			}
+		}
+
 		// hacky way to get history visibility
 		ev = event.Type{"commune.room.banner", 2}
 		banner_event := room.State[ev][""]
@@ -322,6 +359,13 @@ type RoomInfo struct {
 	AvatarURL      string `json:"avatar_url,omitempty"`
 	BannerURL      string `json:"banner_url,omitempty"`
 	Topic          string `json:"topic,omitempty"`
+
+	AvatarInfo *ImageInfo `json:"avatar_info,omitempty"`
+	BannerInfo *ImageInfo `json:"banner_info,omitempty"`
+
+	NumJoinedMembers int   `json:"num_joined_members"`
+	LastActivityTS   int64 `json:"last_activity_ts,omitempty"`
+	MessageCount     int64 `json:"message_count"`
 }
 
 type RoomInfoOptions struct {
@@ -338,8 +382,18 @@ func (c *App) GetRoomInfo(r *RoomInfoOptions) (*RoomInfo, error) {
 		return nil, err
 	}
 
+	return c.NewRoomInfo(r.RoomID, state), nil
+}
+
+// NewRoomInfo builds room info from already fetched room state.
+func (c *App) NewRoomInfo(room_id string, state mautrix.RoomStateMap) *RoomInfo {
+
+	c.IndexStateMedia(id.RoomID(room_id), state)
+
 	room := RoomInfo{
-		RoomID: r.RoomID,
+		RoomID:           room_id,
+		NumJoinedMembers: JoinedMemberCount(state),
+		LastActivityTS:   LatestStateTimestamp(state),
 	}
 
 	name_event := state[event.NewEventType("m.room.name")][""]
@@ -392,7 +446,138 @@ func (c *App) GetRoomInfo(r *RoomInfoOptions) (*RoomInfo, error) {
 		}
 	}
 
-	return &room, nil
+	activity, err := c.GetRoomActivity(room_id)
+	if err != nil {
+		c.Log.Error().Msgf("Error fetching room activity: %v", err)
+	}
+
+	if a, ok := activity[room_id]; ok {
+		room.LastActivityTS = max(room.LastActivityTS, a.LastEventTS)
+		room.MessageCount = a.MessageCount
+	}
+
+	c.AttachRoomImages(&room)
+
+	return &room
+}
+
+// ResolvedRoomInfo is a room's info, along with the child room and event
+// that were asked for, if they were found.
+type ResolvedRoomInfo struct {
+	Info   *RoomInfo
+	Room   *RoomInfo
+	Event  map[string]any
+	Sender *mautrix.RespUserProfile
+}
+
+// ResolveRoomInfo looks up a room's info, a child room in its hierarchy by
+// slug or room ID, and an event in the child room, or in the room itself
+// when no child was asked for. Events are filtered like proxied ones, and
+// left out if they may not be shown.
+func (c *App) ResolveRoomInfo(o *RoomInfoOptions) (*ResolvedRoomInfo, error) {
+
+	info, err := c.GetRoomInfo(o)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := &ResolvedRoomInfo{
+		Info: info,
+	}
+
+	event_room := id.RoomID(o.RoomID)
+
+	if o.ChildRoomID != "" {
+
+		event_room = ""
+
+		hierarchy, err := c.Matrix.Hierarchy(context.Background(), id.RoomID(o.RoomID), nil)
+
+		if err != nil {
+			c.Log.Error().Msgf("Error fetching room hierarchy: %v", err)
+		}
+
+		if hierarchy != nil {
+			for _, child := range hierarchy.Rooms {
+				slug := Slugify(child.Name)
+				if slug != o.ChildRoomID && child.RoomID.String() != o.ChildRoomID {
+					continue
+				}
+
+				resolved.Room = &RoomInfo{
+					RoomID: child.RoomID.String(),
+					Name:   child.Name,
+					Topic:  child.Topic,
+				}
+
+				if !child.AvatarURL.IsEmpty() {
+					resolved.Room.AvatarURL = child.AvatarURL.String()
+				}
+
+				// events are only looked up in children that are exposed
+				if c.RoomExposure(child.RoomID) == nil {
+					event_room = child.RoomID
+				}
+				break
+			}
+		}
+	}
+
+	if o.EventID == "" || event_room == "" {
+		return resolved, nil
+	}
+
+	ev, err := c.VisibleEvent(event_room, id.EventID(o.EventID))
+	if err != nil {
+		c.Log.Error().Msgf("Error fetching event: %v", err)
+	}
+	if ev == nil {
+		return resolved, nil
+	}
+
+	resolved.Event = ev
+
+	// profiles would undo anonymized member lists
+	sender, _ := ev["sender"].(string)
+	if c.MemberPrivacy(event_room) == MemberPrivacyFull && sender != "" {
+		profile, err := c.Matrix.GetProfile(context.Background(), id.UserID(sender))
+		if err != nil {
+			c.Log.Error().Msgf("Error fetching profile: %v", err)
+		}
+		resolved.Sender = profile
+	}
+
+	return resolved, nil
+}
+
+// VisibleEvent fetches a single event and filters it like the /event proxy
+// does. It returns nil if the event may not be shown.
+func (c *App) VisibleEvent(room_id id.RoomID, event_id id.EventID) (map[string]any, error) {
+	ev, err := c.Matrix.GetEvent(context.Background(), room_id, event_id)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered, ok, err := c.FilterTimelineResponse(room_id, body)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	var single map[string]any
+	if err := DecodeJSON(filtered, &single); err != nil {
+		return nil, err
+	}
+
+	if !c.Sanitizer().SanitizeEvent(single) {
+		return nil, nil
+	}
+
+	return single, nil
 }
 
 func (c *App) RoomInfo() http.HandlerFunc {
@@ -421,11 +606,17 @@ func (c *App) RoomInfo() http.HandlerFunc {
 
 			}
 		*/
+
+		// events are only looked up in a child room, as they always were
 		o := &RoomInfoOptions{
-			RoomID: room_id,
+			RoomID:      room_id,
+			ChildRoomID: child_room,
+		}
+		if child_room != "" {
+			o.EventID = event_id
 		}
 
-		info, err := c.GetRoomInfo(o)
+		resolved, err := c.ResolveRoomInfo(o)
 
 		if err != nil {
 			RespondWithError(w, &JSONResponse{
@@ -437,71 +628,20 @@ func (c *App) RoomInfo() http.HandlerFunc {
 			return
 		}
 
-		/*
-			go func() {
-				err := c.AddRoomToCache(info)
-				if err != nil {
-					c.Log.Error().Msgf("Error caching room info: %v", err)
-				}
-			}()
-		*/
-
 		resp := map[string]any{
-			"info": info,
+			"info": resolved.Info,
 		}
 
-		room := RoomInfo{}
-
-		if child_room != "" {
-
-			hierarchy, err := c.Matrix.Hierarchy(context.Background(), id.RoomID(room_id), nil)
-
-			if err != nil {
-				c.Log.Error().Msgf("Error fetching room hierarchy: %v", err)
-			}
-
-			if hierarchy != nil {
-				//c.Log.Info().Msgf("Room hierarchy: %v", hierarchy)
-
-				for _, child := range hierarchy.Rooms {
-					slug := Slugify(child.Name)
-					if slug == child_room || child.RoomID.String() == child_room {
-
-						room = RoomInfo{
-							RoomID: child.RoomID.String(),
-							Name:   child.Name,
-							Topic:  child.Topic,
-						}
-
-						if child.AvatarURL.FileID != "" {
-							room.AvatarURL = fmt.Sprintf("mxc://%s/%s", child.AvatarURL.Homeserver, child.AvatarURL.FileID)
-						}
-
-						resp["room"] = room
-					}
-				}
-			}
+		if resolved.Room != nil {
+			resp["room"] = resolved.Room
 		}
 
-		if event_id != "" && room.RoomID != "" {
+		if resolved.Event != nil {
+			resp["event"] = resolved.Event
+		}
 
-			event, err := c.Matrix.GetEvent(context.Background(), id.RoomID(room.RoomID), id.EventID(event_id))
-			if err != nil {
-				c.Log.Error().Msgf("Error fetching event: %v", err)
-			}
-			if event != nil {
-				c.Log.Info().Msgf("Event: %v", event)
-				resp["event"] = event
-			}
-			if event != nil {
-				profile, err := c.Matrix.GetProfile(context.Background(), event.Sender)
-				if err != nil {
-					c.Log.Error().Msgf("Error fetching profile: %v", err)
-				}
-				if profile != nil {
-					resp["sender"] = profile
-				}
-			}
+		if resolved.Sender != nil {
+			resp["sender"] = resolved.Sender
 		}
 
 		RespondWithJSON(w, &JSONResponse{
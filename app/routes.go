@@ -19,6 +19,7 @@ func (c *App) Routes() {
 
 	// c.Router.Use(middleware.ThrottleBacklog(10, 50, time.Second*10))
 	c.Router.Use(middleware.RequestID)
+	c.Router.Use(KeepPeerAddr)
 	c.Router.Use(middleware.RealIP)
 	c.Router.Use(middleware.Logger)
 	c.Router.Use(middleware.StripSlashes)
@@ -57,37 +58,96 @@ func routes(c *App) chi.Router {
 		r.Put("/transactions/{txnId}", c.Transactions())
 	})
 
+	r.Route("/_commune/admin/v1", func(r chi.Router) {
+		r.Use(c.AuthenticateAdmin)
+		r.Get("/hidden/{kind}", c.ListHidden())
+		r.Put("/hidden/{kind}/{target}", c.SetHidden(true))
+		r.Delete("/hidden/{kind}/{target}", c.SetHidden(false))
+		r.Get("/audit", c.ModerationAuditLog())
+		r.Get("/reports", c.ListReports())
+	})
+
 	r.Route("/_matrix/client/v3/rooms/{room_id}", func(r chi.Router) {
+		r.Use(c.ResolveMediaURLs)
 		r.Use(c.ValidateRoomID)
 		r.Use(c.ValidatePublicRoom)
-		r.Get("/info", c.RoomInfo())
-		r.Get("/aliases", c.MatrixAPIProxy())
-		r.Get("/event/*", c.MatrixAPIProxy())
-		r.Get("/context/*", c.MatrixAPIProxy())
-		r.Route("/state", func(r chi.Router) {
-			r.Get("/", c.StateProxy())
+		r.With(c.EndpointEnabled("info")).Get("/info", c.RoomInfo())
+		r.Group(func(r chi.Router) {
+			r.Use(c.RequireEndpoint("state"))
+			r.With(c.EndpointEnabled("aliases")).Get("/aliases", c.MatrixAPIProxy())
+			r.Route("/state", func(r chi.Router) {
+				r.Use(c.EndpointEnabled("state"))
+				r.Get("/", c.StateProxy())
+			})
+			r.With(c.EndpointEnabled("state")).Get("/state/*", c.RewritingProxy(c.RewriteStateEvent))
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(c.RequireEndpoint("members"))
+			r.With(c.EndpointEnabled("joined_members")).Get("/joined_members", c.RewritingProxy(c.RewriteJoinedMembers))
+			r.With(c.EndpointEnabled("members")).Get("/members", c.RewritingProxy(c.RewriteMembers))
 		})
-		r.Get("/state/*", c.MatrixAPIProxy())
-		r.Get("/joined_members", c.MatrixAPIProxy())
-		r.Get("/members", c.MatrixAPIProxy())
-		r.Get("/timestamp_to_event", c.MatrixAPIProxy())
-		r.Route("/messages", func(r chi.Router) {
-			r.Get("/", c.MessagesProxy())
+		r.Group(func(r chi.Router) {
+			r.Use(c.RequireEndpoint("messages"))
+			r.With(c.EndpointEnabled("event")).Get("/event/*", c.TimelineProxy())
+			r.With(c.EndpointEnabled("context")).Get("/context/*", c.TimelineProxy())
+			r.With(c.EndpointEnabled("timestamp_to_event")).Get("/timestamp_to_event", c.MatrixAPIProxy())
+			r.With(c.EndpointEnabled("report")).Post("/report/{event_id}", c.ReportEvent())
+			r.With(c.EndpointEnabled("gallery")).Get("/gallery", c.RoomGallery())
+			r.Route("/messages", func(r chi.Router) {
+				r.Use(c.EndpointEnabled("messages"))
+				r.Get("/", c.MessagesProxy())
+			})
 		})
 	})
 
 	r.Route("/_matrix/client/v1/rooms/{room_id}", func(r chi.Router) {
+		r.Use(c.ResolveMediaURLs)
 		r.Use(c.ValidateRoomID)
 		r.Use(c.ValidatePublicRoom)
-		r.Get("/hierarchy", c.MatrixAPIProxy())
-		r.Get("/threads", c.MatrixAPIProxy())
-		r.Get("/relations/*", c.MatrixAPIProxy())
+		r.With(c.EndpointEnabled("hierarchy")).Get("/hierarchy", c.RewritingProxy(nil))
+		r.Group(func(r chi.Router) {
+			r.Use(c.RequireEndpoint("messages"))
+			r.With(c.EndpointEnabled("threads")).Get("/threads", c.TimelineProxy())
+			r.With(c.EndpointEnabled("relations")).Get("/relations/*", c.TimelineProxy())
+		})
+	})
+
+	for _, prefix := range []string{"/_matrix/media/v3", "/_matrix/client/v1/media"} {
+		r.Route(prefix, func(r chi.Router) {
+			r.Get("/download/{server_name}/{media_id}", c.MediaProxy(false))
+			r.Get("/download/{server_name}/{media_id}/{file_name}", c.MediaProxy(false))
+			r.Get("/thumbnail/{server_name}/{media_id}", c.MediaProxy(true))
+		})
+	}
+
+	r.Route("/_matrix/client/v3/publicRooms", func(r chi.Router) {
+		r.Use(c.ResolveMediaURLs)
+		r.Get("/", c.SpecPublicRooms())
+		r.Post("/", c.SpecPublicRooms())
 	})
 
 	r.Route("/publicRooms", func(r chi.Router) {
+		r.Use(c.ResolveMediaURLs)
 		r.Get("/", c.PublicRooms())
+		r.Get("/hierarchy", c.SpaceHierarchy())
 	})
 
+	if c.Config.Pages.Enabled {
+		r.Get("/sitemap.xml", c.Sitemap())
+		r.Get("/sitemap-{page}.xml", c.Sitemap())
+
+		r.Route("/view", func(r chi.Router) {
+			r.Get("/room/{room_id}", c.RoomPage())
+			r.Get("/room/{room_id}/event/{event_id}", c.EventPage())
+			r.Get("/space/{room_id}", c.SpacePage())
+			r.Get("/room/{room_id}/feed.{format}", c.RoomFeed())
+			r.Get("/room/{room_id}/thread/{event_id}/feed.{format}", c.ThreadFeed())
+			r.Get("/space/{room_id}/feed.{format}", c.SpaceFeed())
+			r.Get("/card/room/{room_id}", c.CardProxy())
+			r.Get("/card/room/{room_id}/event/{event_id}", c.CardProxy())
+		})
+	}
+
 	r.Route("/sync", func(r chi.Router) {
 		r.Get("/", c.Sync())
 	})
@@ -125,7 +185,7 @@ func (c *App) CORS() {
 	cors := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"X-PINGOTHER", "Accept", "Authorization", "Image", "Attachment", "File-Type", "Content-Type", "X-CSRF-Token", "Access-Control-Allow-Origin"},
+		AllowedHeaders:   []string{"X-PINGOTHER", "Accept", "Authorization", "Image", "Attachment", "File-Type", "Content-Type", "X-CSRF-Token", "X-Commune-Media-URLs", "Access-Control-Allow-Origin"},
 		ExposedHeaders:   []string{"Link"},
 		AllowCredentials: true,
 		MaxAge:           300,
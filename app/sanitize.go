@@ -0,0 +1,290 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// fields stripped from events when strip_fields isn't configured
+var defaultStripFields = []string{
+	"unsigned.prev_content",
+	"unsigned.transaction_id",
+	"unsigned.age",
+	"m.room.member:content.reason",
+}
+
+// keys whose values are lists of events, wherever they turn up in a response
+var eventListKeys = map[string]bool{
+	"chunk":          true,
+	"events_before":  true,
+	"events_after":   true,
+	"state":          true,
+	"children_state": true,
+}
+
+// FieldPath is a dotted path to a field in an event, optionally limited to
+// one event type, e.g. "m.room.member:content.reason".
+type FieldPath struct {
+	Type string
+	Path []string
+}
+
+func ParseFieldPath(s string) FieldPath {
+	fp := FieldPath{}
+	if t, path, ok := strings.Cut(s, ":"); ok {
+		fp.Type = t
+		s = path
+	}
+	fp.Path = strings.Split(s, ".")
+	return fp
+}
+
+// Sanitizer controls what parts of events leave the server.
+type Sanitizer struct {
+	Strip   []FieldPath
+	Allowed []string
+}
+
+func (c *App) Sanitizer() *Sanitizer {
+	fields := c.Config.Sanitize.StripFields
+	if fields == nil {
+		fields = defaultStripFields
+	}
+
+	s := &Sanitizer{
+		Allowed: c.Config.Sanitize.AllowedEventTypes,
+	}
+
+	for _, field := range fields {
+		s.Strip = append(s.Strip, ParseFieldPath(field))
+	}
+
+	return s
+}
+
+// Allows reports whether an event type may be shown at all. An empty
+// allowlist allows everything.
+func (s *Sanitizer) Allows(event_type string) bool {
+	return len(s.Allowed) == 0 || Contains(s.Allowed, event_type)
+}
+
+// SanitizeEvent strips the configured fields from an event, and returns
+// false if the event type isn't allowed. Gap markers are always allowed, so
+// that clients can still tell when events were left out.
+func (s *Sanitizer) SanitizeEvent(ev map[string]any) bool {
+	event_type, _ := ev["type"].(string)
+
+	if !s.Allows(event_type) && !IsGapMarker(ev) {
+		return false
+	}
+
+	for _, fp := range s.Strip {
+		if fp.Type != "" && fp.Type != event_type {
+			continue
+		}
+		StripField(ev, fp.Path)
+	}
+
+	return true
+}
+
+// SanitizeContent strips fields from the bare content of a state event, as
+// returned by /state/{eventType}/{stateKey}.
+func (s *Sanitizer) SanitizeContent(event_type string, content map[string]any) bool {
+	if !s.Allows(event_type) {
+		return false
+	}
+
+	for _, fp := range s.Strip {
+		if fp.Type != "" && fp.Type != event_type {
+			continue
+		}
+		if len(fp.Path) > 1 && fp.Path[0] == "content" {
+			StripField(content, fp.Path[1:])
+		}
+	}
+
+	return true
+}
+
+func StripField(m map[string]any, path []string) {
+	for i, key := range path {
+		if i == len(path)-1 {
+			delete(m, key)
+			return
+		}
+		next, ok := m[key].(map[string]any)
+		if !ok {
+			return
+		}
+		m = next
+	}
+}
+
+// Stream copies a JSON document from src to dst, sanitizing events as it
+// goes. Only one event is held in memory at a time; everything else is
+// passed through token by token. root names the kind of value at the top
+// level, e.g. "state" for the bare list of events returned by /state.
+func (s *Sanitizer) Stream(dst io.Writer, src io.Reader, root string) error {
+	dec := json.NewDecoder(src)
+	dec.UseNumber()
+
+	w := bufio.NewWriter(dst)
+
+	if err := s.streamValue(dec, w, root); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+func (s *Sanitizer) streamValue(dec *json.Decoder, w *bufio.Writer, key string) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return writeJSON(w, tok)
+	}
+
+	switch delim {
+	case '{':
+		w.WriteByte('{')
+		first := true
+		for dec.More() {
+			kt, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			k, _ := kt.(string)
+
+			if !first {
+				w.WriteByte(',')
+			}
+			first = false
+
+			if err := writeJSON(w, k); err != nil {
+				return err
+			}
+			w.WriteByte(':')
+
+			if k == "event" {
+				err = s.streamEvent(dec, w)
+			} else {
+				err = s.streamValue(dec, w, k)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+		w.WriteByte('}')
+
+	case '[':
+		w.WriteByte('[')
+		events := eventListKeys[key]
+		first := true
+		for dec.More() {
+			if events {
+				var v any
+				if err := dec.Decode(&v); err != nil {
+					return err
+				}
+				if ev, ok := AsEvent(v); ok {
+					if !s.SanitizeEvent(ev) {
+						continue
+					}
+				} else {
+					v = s.SanitizeValue(v, "")
+				}
+				if !first {
+					w.WriteByte(',')
+				}
+				if err := writeJSON(w, v); err != nil {
+					return err
+				}
+			} else {
+				if !first {
+					w.WriteByte(',')
+				}
+				if err := s.streamValue(dec, w, ""); err != nil {
+					return err
+				}
+			}
+			first = false
+		}
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+		w.WriteByte(']')
+	}
+
+	return nil
+}
+
+// SanitizeValue sanitizes the event lists nested in an already decoded
+// value, such as the children_state of a room in a /hierarchy chunk.
+func (s *Sanitizer) SanitizeValue(v any, key string) any {
+	switch val := v.(type) {
+	case map[string]any:
+		for k, child := range val {
+			val[k] = s.SanitizeValue(child, k)
+		}
+	case []any:
+		events := eventListKeys[key]
+		filtered := make([]any, 0, len(val))
+		for _, item := range val {
+			if ev, ok := AsEvent(item); ok && events {
+				if s.SanitizeEvent(ev) {
+					filtered = append(filtered, ev)
+				}
+				continue
+			}
+			filtered = append(filtered, s.SanitizeValue(item, ""))
+		}
+		return filtered
+	}
+	return v
+}
+
+// a single event that isn't allowed is replaced with null
+func (s *Sanitizer) streamEvent(dec *json.Decoder, w *bufio.Writer) error {
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+	if ev, ok := AsEvent(v); ok && !s.SanitizeEvent(ev) {
+		v = nil
+	}
+	return writeJSON(w, v)
+}
+
+// AsEvent returns v if it looks like an event. Some lists named like event
+// lists hold other things, e.g. the rooms in a /hierarchy chunk.
+func AsEvent(v any) (map[string]any, bool) {
+	ev, ok := v.(map[string]any)
+	if !ok {
+		return nil, false
+	}
+	_, has_type := ev["type"].(string)
+	_, has_content := ev["content"]
+	return ev, has_type && has_content
+}
+
+func writeJSON(w io.Writer, v any) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	_, err := w.Write(bytes.TrimRight(buf.Bytes(), "\n"))
+	return err
+}
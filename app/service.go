@@ -16,7 +16,9 @@ func (c *App) JoinRoom(room_id id.RoomID) error {
 		c.Log.Error().Msgf("Error joining room: %v", err)
 		return err
 	}
-	return nil
+
+	// the room may have been cached as not joined
+	return c.InvalidateRoomExposure(room_id)
 }
 
 func (c *App) LeaveRoom(room_id id.RoomID) error {
@@ -26,12 +28,12 @@ func (c *App) LeaveRoom(room_id id.RoomID) error {
 		return err
 	}
 
-	err = c.RemoveRoomFromCache(room_id)
+	err = c.PurgeRoom(room_id)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return c.InvalidateRoomExposure(room_id)
 }
 
 func (c *App) ProcessRoom(room_id id.RoomID) error {
@@ -68,13 +70,28 @@ func (c *App) ProcessRoom(room_id id.RoomID) error {
 		return err
 	}
 
+	c.AttachRoomImages(info)
+
 	err = c.AddRoomToCache(info)
 	if err != nil {
 		return err
 	}
 
-	evt := event.Type{"commune.room.public", 2}
-	e, err := c.Matrix.SendStateEvent(context.Background(), room_id, evt, "", map[string]interface{}{
+	c.UpdateRoomImages(info.RoomID)
+
+	go c.BackfillGallery(room_id)
+
+	// don't overwrite an opt-out by room moderators
+	var public struct {
+		Public *bool `json:"public"`
+	}
+	err = c.Matrix.StateEvent(context.Background(), room_id, RoomPublicEvent, "", &public)
+	if err == nil && public.Public != nil && !*public.Public {
+		c.Log.Info().Msgf("Room has opted out of public access: %v", room_id)
+		return nil
+	}
+
+	e, err := c.Matrix.SendStateEvent(context.Background(), room_id, RoomPublicEvent, "", map[string]interface{}{
 		"public": true,
 	})
 
@@ -115,12 +132,38 @@ func (c *App) Transactions() http.HandlerFunc {
 					c.Log.Error().Msgf("Couldn't marshal event %v", err)
 					return
 				}
-				err = c.CacheEvent(event.ID, json)
+				err = c.CacheEvent(event.RoomID, event.ID, json)
 				if err != nil {
 					c.Log.Error().Msgf("Error caching event: %v", err)
 				}
 			}()
 
+			err := c.RecordActivity(&event)
+			if err != nil {
+				c.Log.Error().Msgf("Error recording room activity: %v", err)
+			}
+
+			c.IndexNewEventMedia(&event)
+
+			err = c.IndexGalleryEvent(&event)
+			if err != nil {
+				c.Log.Error().Msgf("Error indexing gallery event: %v", err)
+			}
+
+			err = c.IndexThreadEvent(&event)
+			if err != nil {
+				c.Log.Error().Msgf("Error indexing thread event: %v", err)
+			}
+
+			if c.Policy.IsList(event.RoomID) {
+				if _, ok := PolicyRuleKind(event.Type.Type); ok && event.StateKey != nil {
+					c.Policy.SetRule(event.RoomID, event.Type.Type, *event.StateKey, event.Content.Raw)
+					go c.RebuildPublicRoomsCache()
+					// cached pages were filtered against the old rules
+					go c.ClearMessagesCache()
+				}
+			}
+
 			switch event.Type.Type {
 			case "m.room.message":
 				/*
@@ -130,15 +173,47 @@ func (c *App) Transactions() http.HandlerFunc {
 					}
 				*/
 			case "m.room.redaction":
-				err := c.CacheRoomMessages(event.RoomID.String())
+				// the next request refills the cache through the filters
+				err := c.Cache.Messages.Del(context.Background(), event.RoomID.String()).Err()
 				if err != nil {
-					c.Log.Error().Msgf("Error caching messages: %v", err)
+					c.Log.Error().Msgf("Couldn't remove room messages from cache %v", err)
+				}
+
+				// newer room versions move redacts into the content
+				redacts := event.Redacts
+				if r, ok := event.Content.Raw["redacts"].(string); ok && redacts == "" {
+					redacts = id.EventID(r)
+				}
+				if redacts != "" {
+					err = c.RemoveGalleryEvent(event.RoomID, redacts)
+					if err != nil {
+						c.Log.Error().Msgf("Error removing gallery event: %v", err)
+					}
+					err = c.UncacheEvent(event.RoomID, redacts)
+					if err != nil {
+						c.Log.Error().Msgf("Error removing cached event: %v", err)
+					}
+					err = c.RemoveThread(event.RoomID, redacts)
+					if err != nil {
+						c.Log.Error().Msgf("Error removing thread: %v", err)
+					}
+					c.RemoveEventMedia(redacts.String())
 				}
 			case "m.room.history_visibility":
+				c.RoomExposureChanged(event.RoomID)
+
 				state, ok := event.Content.Raw["history_visibility"].(string)
 
+				if ok {
+					err := c.RecordVisibilityChange(event.RoomID, event.ID, event.Timestamp, state)
+					if err != nil {
+						c.Log.Error().Msgf("Error recording history visibility: %v", err)
+					}
+				}
+
 				if ok && state == "world_readable" &&
-					c.Config.AppService.Rules.AutoJoin {
+					c.Config.AppService.Rules.AutoJoin &&
+					c.AllowsJoin(event.RoomID, "") {
 					err = c.ProcessRoom(event.RoomID)
 					if err != nil {
 						//http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -146,14 +221,18 @@ func (c *App) Transactions() http.HandlerFunc {
 					}
 				}
 
-				/*
-					if ok && state != "world_readable" {
-						err = c.LeaveRoom(event.RoomID)
-						if err != nil {
-							c.Log.Error().Msgf("Error leaving room: %v", err)
-						}
-					}
-				*/
+			case "m.room.server_acl":
+				c.ServerACLChanged(event.RoomID)
+
+			case "m.room.join_rules", "m.room.power_levels":
+				c.RoomExposureChanged(event.RoomID)
+
+			case "commune.room.public", "commune.room.exposure":
+				// the appservice's own changes follow from an evaluation
+				// that's already been made
+				if event.Sender != c.Matrix.UserID {
+					c.RoomExposureChanged(event.RoomID)
+				}
 
 			case "m.room.member":
 
@@ -179,6 +258,10 @@ func (c *App) Transactions() http.HandlerFunc {
 							join_room = false
 						}
 
+						if join_room && !c.AllowsJoin(event.RoomID, event.Sender) {
+							join_room = false
+						}
+
 						if join_room {
 
 							err = c.ProcessRoom(event.RoomID)
@@ -202,6 +285,7 @@ func (c *App) Transactions() http.HandlerFunc {
 				}
 
 			case "m.room.name":
+				c.InvalidateRoomCard(event.RoomID)
 				name, ok := event.Content.Raw["name"].(string)
 				c.Log.Info().Msgf("New room name, updating cache value: %v", name)
 				if ok {
@@ -219,10 +303,11 @@ func (c *App) Transactions() http.HandlerFunc {
 					}
 				}
 			case "m.room.avatar":
+				c.InvalidateRoomCard(event.RoomID)
 				url, ok := event.Content.Raw["url"].(string)
 				c.Log.Info().Msgf("New room avatar, updating cache value: %v", url)
 				if ok {
-					err := c.UpdateRoomInfoCache(event.RoomID.String())
+					err := c.RefreshRoomImages(event.RoomID)
 					if err != nil {
 						/*
 							RespondWithError(w, &JSONResponse{
@@ -235,7 +320,16 @@ func (c *App) Transactions() http.HandlerFunc {
 						*/
 					}
 				}
+			case "commune.room.banner":
+				c.InvalidateRoomCard(event.RoomID)
+				url, _ := event.Content.Raw["url"].(string)
+				c.Log.Info().Msgf("New room banner, updating cache value: %v", url)
+				err := c.RefreshRoomImages(event.RoomID)
+				if err != nil {
+					c.Log.Error().Msgf("Error updating room images: %v", err)
+				}
 			case "m.room.topic":
+				c.InvalidateRoomCard(event.RoomID)
 				topic, ok := event.Content.Raw["topic"].(string)
 				c.Log.Info().Msgf("New room topic, updating cache value: %v", topic)
 				if ok {
@@ -0,0 +1,83 @@
+package app
+
+import (
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+)
+
+var (
+	RoomPublicEvent   = event.Type{Type: "commune.room.public", Class: event.StateEventType}
+	RoomExposureEvent = event.Type{Type: "commune.room.exposure", Class: event.StateEventType}
+)
+
+// EndpointExposure says which groups of proxied endpoints are exposed for a
+// room.
+type EndpointExposure struct {
+	Messages bool `json:"messages"`
+	Members  bool `json:"members"`
+	State    bool `json:"state"`
+}
+
+// moderatorEvent returns a Commune settings event from room state, unless it
+// was sent by someone without the power to send it.
+func moderatorEvent(state mautrix.RoomStateMap, evt event.Type) *event.Event {
+	ev := state[evt][""]
+	if ev == nil {
+		return nil
+	}
+	if !CanSendState(state, ev.Sender, evt) {
+		return nil
+	}
+	return ev
+}
+
+// OptedOut reports whether room moderators have set commune.room.public to
+// false.
+func OptedOut(state mautrix.RoomStateMap) bool {
+	ev := moderatorEvent(state, RoomPublicEvent)
+	if ev == nil {
+		return false
+	}
+	public, ok := ev.Content.Raw["public"].(bool)
+	return ok && !public
+}
+
+// ReadEndpointExposure reads commune.room.exposure from room state. Endpoint
+// groups that aren't mentioned stay exposed.
+func ReadEndpointExposure(state mautrix.RoomStateMap) EndpointExposure {
+	exposure := EndpointExposure{
+		Messages: true,
+		Members:  true,
+		State:    true,
+	}
+
+	ev := moderatorEvent(state, RoomExposureEvent)
+	if ev == nil {
+		return exposure
+	}
+
+	if v, ok := ev.Content.Raw["messages"].(bool); ok {
+		exposure.Messages = v
+	}
+	if v, ok := ev.Content.Raw["members"].(bool); ok {
+		exposure.Members = v
+	}
+	if v, ok := ev.Content.Raw["state"].(bool); ok {
+		exposure.State = v
+	}
+
+	return exposure
+}
+
+// Allows reports whether a group of endpoints is exposed.
+func (e *EndpointExposure) Allows(group string) bool {
+	switch group {
+	case "messages":
+		return e.Messages
+	case "members":
+		return e.Members
+	case "state":
+		return e.State
+	}
+	return true
+}
@@ -10,6 +10,8 @@ import (
 )
 
 func (c *App) Setup() {
+	c.LoadPolicyLists()
+
 	// build a cache of rooms that appservice has joined
 	rooms, err := c.Matrix.JoinedRooms(context.Background())
 	if err != nil {
@@ -17,28 +19,41 @@ func (c *App) Setup() {
 		return
 	}
 
-	if len(rooms.JoinedRooms) > 0 {
-		for _, room_id := range rooms.JoinedRooms {
+	if len(rooms.JoinedRooms) == 0 {
+		return
+	}
 
-			info, err := c.GetRoomInfo(&RoomInfoOptions{
-				RoomID: room_id.String(),
-			})
-			if err != nil {
-				c.Log.Error().Msgf("Error fetching room info: %v", err)
-			}
+	c.Log.Info().Msgf("Fetching state for %d joined rooms", len(rooms.JoinedRooms))
 
-			if info != nil {
-				c.AddRoomToCache(info)
-				if err != nil {
-					c.Log.Error().Msgf("Error adding room to cache: %v", err)
-				}
-			}
+	fetched := c.FetchRoomStates(context.Background(), rooms.JoinedRooms)
 
+	for _, room := range fetched.States {
+		info := c.NewRoomInfo(room.RoomID.String(), room.State)
+		err := c.AddRoomToCache(info)
+		if err != nil {
+			c.Log.Error().Msgf("Error adding room to cache: %v", err)
 		}
 	}
 
+	// leave the public rooms cache to be built on demand if any room
+	// failed, rather than cache an incomplete listing
+	if err := fetched.Err(); err != nil {
+		c.Log.Warn().Msgf("Not caching public rooms: %v", err)
+		return
+	}
+
 	c.Log.Info().Msg("Rebuilding public rooms cache")
-	c.RebuildPublicRoomsCache()
+
+	public_rooms, err := ProcessPublicRooms(c.EligibleRooms(fetched.States))
+	if err != nil {
+		c.Log.Error().Msgf("Error processing public rooms: %v", err)
+		return
+	}
+
+	err = c.CachePublicRooms(public_rooms)
+	if err != nil {
+		c.Log.Error().Msgf("Error caching public rooms: %v", err)
+	}
 }
 
 func (c *App) JoinPublicRooms() {
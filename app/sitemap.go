@@ -0,0 +1,297 @@
+package app
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/redis/go-redis/v9"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// the protocol allows up to 50,000 URLs in each sitemap, but smaller pages
+// are kinder to crawlers
+const SitemapPageSize = 10000
+
+// how many thread roots are remembered for each room
+const maxIndexedThreads = 1000
+
+const sitemapXMLNS = "http://www.sitemaps.org/schemas/sitemap/0.9"
+
+// the generated sitemaps, under "index" for the sitemap index and the page
+// number for each page
+const sitemapsKey = "sitemaps"
+
+// thread roots in a room, scored by the timestamp of their latest reply
+func threadsKey(room_id string) string {
+	return fmt.Sprintf("threads:%s", room_id)
+}
+
+// IndexThreadEvent records a thread's latest activity when a reply to it
+// arrives.
+func (c *App) IndexThreadEvent(ev *event.Event) error {
+	relates, ok := ev.Content.Raw["m.relates_to"].(map[string]any)
+	if !ok {
+		return nil
+	}
+	if rel, _ := relates["rel_type"].(string); rel != "m.thread" {
+		return nil
+	}
+	root, _ := relates["event_id"].(string)
+	if root == "" || ev.RoomID == "" {
+		return nil
+	}
+
+	ctx := context.Background()
+	key := threadsKey(ev.RoomID.String())
+
+	pipe := c.Cache.Rooms.Pipeline()
+	pipe.ZAddGT(ctx, key, redis.Z{
+		Score:  float64(ev.Timestamp),
+		Member: root,
+	})
+	pipe.ZRemRangeByRank(ctx, key, 0, -maxIndexedThreads-1)
+	_, err := pipe.Exec(ctx)
+
+	return err
+}
+
+// RemoveThread stops listing a thread whose root event was redacted.
+func (c *App) RemoveThread(room_id id.RoomID, root id.EventID) error {
+	return c.Cache.Rooms.ZRem(context.Background(), threadsKey(room_id.String()), root.String()).Err()
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name     `xml:"sitemapindex"`
+	XMLNS    string       `xml:"xmlns,attr"`
+	Sitemaps []sitemapURL `xml:"sitemap"`
+}
+
+// sitemapTime formats a timestamp in milliseconds as the W3C datetime
+// sitemaps use, or returns nothing for unknown times.
+func sitemapTime(ts int64) string {
+	if ts <= 0 {
+		return ""
+	}
+	return time.UnixMilli(ts).UTC().Format(time.RFC3339)
+}
+
+// SitemapSchedule returns the cron spec sitemaps are regenerated on.
+func (c *App) SitemapSchedule() string {
+	if c.Config.Sitemap.Schedule != "" {
+		return c.Config.Sitemap.Schedule
+	}
+	return "@hourly"
+}
+
+// SitemapThreadsPerRoom returns how many of each room's most recently
+// active threads are listed.
+func (c *App) SitemapThreadsPerRoom() int {
+	if c.Config.Sitemap.ThreadsPerRoom > 0 {
+		return min(c.Config.Sitemap.ThreadsPerRoom, maxIndexedThreads)
+	}
+	return 20
+}
+
+// RecentThreads lists the pages of a room's most recently active threads
+// whose root events may be shown.
+func (c *App) RecentThreads(room_id id.RoomID, count int) ([]sitemapURL, error) {
+	ctx := context.Background()
+
+	zs, err := c.Cache.Rooms.ZRevRangeWithScores(ctx, threadsKey(room_id.String()), 0, int64(count-1)).Result()
+	if err != nil || len(zs) == 0 {
+		return nil, err
+	}
+
+	roots := make([]string, 0, len(zs))
+	for _, z := range zs {
+		root, _ := z.Member.(string)
+		roots = append(roots, root)
+	}
+
+	values, err := c.Cache.Events.MGet(ctx, roots...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := c.NewEventFilter(room_id)
+	if err != nil {
+		return nil, err
+	}
+	sanitizer := c.Sanitizer()
+
+	urls := []sitemapURL{}
+	for i, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			continue
+		}
+
+		var ev map[string]any
+		if err := DecodeJSON([]byte(s), &ev); err != nil {
+			continue
+		}
+		if !f.Visible(ev) || !sanitizer.SanitizeEvent(ev) {
+			continue
+		}
+
+		urls = append(urls, sitemapURL{
+			Loc:     c.PublicURL() + EventPagePath(room_id.String(), roots[i]),
+			LastMod: sitemapTime(int64(zs[i].Score)),
+		})
+	}
+
+	return urls, nil
+}
+
+// SitemapURLs lists the pages of every exposed space and room, and of the
+// recent threads in rooms whose messages are exposed.
+func (c *App) SitemapURLs() ([]sitemapURL, error) {
+	rooms, err := c.ListPublicRooms()
+	if err != nil {
+		return nil, err
+	}
+
+	urls := []sitemapURL{}
+
+	for _, room := range rooms {
+		room_id := id.RoomID(room.RoomID)
+
+		if err := c.RoomExposure(room_id); err != nil {
+			continue
+		}
+
+		lastmod := sitemapTime(max(room.LastActivityTS, room.OriginServerTS))
+
+		if room.Type == "m.space" {
+			urls = append(urls, sitemapURL{
+				Loc:     c.PublicURL() + SpacePagePath(room.RoomID),
+				LastMod: lastmod,
+			})
+			continue
+		}
+
+		urls = append(urls, sitemapURL{
+			Loc:     c.PublicURL() + RoomPagePath(room.RoomID),
+			LastMod: lastmod,
+		})
+
+		endpoints, err := c.RoomEndpoints(room_id)
+		if err != nil || !endpoints.Allows("messages") || c.EndpointDisabled(room_id, "event") {
+			continue
+		}
+
+		threads, err := c.RecentThreads(room_id, c.SitemapThreadsPerRoom())
+		if err != nil {
+			c.Log.Error().Msgf("Error listing threads for sitemap: %v", err)
+			continue
+		}
+		urls = append(urls, threads...)
+	}
+
+	return urls, nil
+}
+
+// GenerateSitemaps rebuilds the sitemap index and its pages, replacing the
+// previous ones all at once.
+func (c *App) GenerateSitemaps() {
+	if !c.Config.Pages.Enabled {
+		return
+	}
+
+	urls, err := c.SitemapURLs()
+	if err != nil {
+		c.Log.Error().Msgf("Error generating sitemaps: %v", err)
+		return
+	}
+
+	index := &sitemapIndex{XMLNS: sitemapXMLNS}
+	fields := map[string]any{}
+
+	for page := 1; len(urls) > 0 || page == 1; page++ {
+		n := min(len(urls), SitemapPageSize)
+
+		set := &sitemapURLSet{XMLNS: sitemapXMLNS, URLs: urls[:n]}
+		urls = urls[n:]
+
+		b, err := xml.Marshal(set)
+		if err != nil {
+			c.Log.Error().Msgf("Error encoding sitemap: %v", err)
+			return
+		}
+		fields[strconv.Itoa(page)] = xml.Header + string(b)
+
+		// a page was last modified when its newest entry was
+		lastmod := ""
+		for _, u := range set.URLs {
+			lastmod = max(lastmod, u.LastMod)
+		}
+
+		index.Sitemaps = append(index.Sitemaps, sitemapURL{
+			Loc:     fmt.Sprintf("%s/sitemap-%d.xml", c.PublicURL(), page),
+			LastMod: lastmod,
+		})
+	}
+
+	b, err := xml.Marshal(index)
+	if err != nil {
+		c.Log.Error().Msgf("Error encoding sitemap index: %v", err)
+		return
+	}
+	fields["index"] = xml.Header + string(b)
+
+	ctx := context.Background()
+	pipe := c.Cache.Rooms.TxPipeline()
+	pipe.Del(ctx, sitemapsKey)
+	pipe.HSet(ctx, sitemapsKey, fields)
+	if _, err := pipe.Exec(ctx); err != nil {
+		c.Log.Error().Msgf("Couldn't store sitemaps: %v", err)
+		return
+	}
+
+	c.Log.Info().Msgf("Generated %d sitemaps", len(index.Sitemaps))
+}
+
+// Sitemap serves the sitemap index, or one of its pages.
+func (c *App) Sitemap() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		field := "index"
+		if page := chi.URLParam(r, "page"); page != "" {
+			if n, err := strconv.Atoi(page); err != nil || n < 1 {
+				http.NotFound(w, r)
+				return
+			}
+			field = page
+		}
+
+		sitemap, err := c.Cache.Rooms.HGet(r.Context(), sitemapsKey, field).Result()
+		if err != nil {
+			if err != redis.Nil {
+				c.Log.Error().Msgf("Couldn't read sitemap: %v", err)
+			}
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		w.Write([]byte(sitemap))
+	}
+}
@@ -0,0 +1,267 @@
+package app
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+)
+
+type SpaceChild struct {
+	RoomID    string `json:"room_id"`
+	Order     string `json:"order,omitempty"`
+	Suggested bool   `json:"suggested,omitempty"`
+
+	// timestamp of the m.space.child event, used to break ordering ties
+	Timestamp int64 `json:"origin_server_ts"`
+}
+
+// ValidChildOrder checks an m.space.child order string against the spec:
+// at most 50 characters in the printable ASCII range.
+func ValidChildOrder(order string) bool {
+	if order == "" || len(order) > 50 {
+		return false
+	}
+	for i := 0; i < len(order); i++ {
+		if order[i] < 0x20 || order[i] > 0x7E {
+			return false
+		}
+	}
+	return true
+}
+
+// SortSpaceChildren orders children as the spec describes: children with an
+// order come first, sorted lexicographically, then by the timestamp of the
+// m.space.child event, then by room ID.
+func SortSpaceChildren(children []SpaceChild) {
+	sort.SliceStable(children, func(i, j int) bool {
+		a, b := children[i], children[j]
+
+		if a.Order != b.Order {
+			if a.Order == "" {
+				return false
+			}
+			if b.Order == "" {
+				return true
+			}
+			return a.Order < b.Order
+		}
+
+		if a.Timestamp != b.Timestamp {
+			return a.Timestamp < b.Timestamp
+		}
+
+		return a.RoomID < b.RoomID
+	})
+}
+
+// SpaceChildren returns a space's known children in spec order. Children
+// without a via list have been removed from the space and are skipped.
+func SpaceChildren(state mautrix.RoomStateMap, known map[string]bool) []SpaceChild {
+	children := []SpaceChild{}
+
+	for child, ev := range state[event.StateSpaceChild] {
+		if ev == nil || !HasVia(ev) || !known[child] {
+			continue
+		}
+
+		sc := SpaceChild{
+			RoomID:    child,
+			Timestamp: ev.Timestamp,
+		}
+
+		if order, ok := ev.Content.Raw["order"].(string); ok && ValidChildOrder(order) {
+			sc.Order = order
+		}
+
+		if suggested, ok := ev.Content.Raw["suggested"].(bool); ok {
+			sc.Suggested = suggested
+		}
+
+		children = append(children, sc)
+	}
+
+	SortSpaceChildren(children)
+
+	return children
+}
+
+// SpaceParents returns the known parents a room claims via m.space.parent.
+func SpaceParents(state mautrix.RoomStateMap, known map[string]bool) []string {
+	parents := []string{}
+
+	for parent, ev := range state[event.StateSpaceParent] {
+		if ev == nil || !HasVia(ev) || !known[parent] {
+			continue
+		}
+		parents = append(parents, parent)
+	}
+
+	sort.Strings(parents)
+
+	return parents
+}
+
+func HasVia(ev *event.Event) bool {
+	via, ok := ev.Content.Raw["via"].([]any)
+	return ok && len(via) > 0
+}
+
+type SpaceNode struct {
+	PublicRoom
+	Order     string       `json:"order,omitempty"`
+	Suggested bool         `json:"suggested,omitempty"`
+	Cycle     bool         `json:"cycle,omitempty"`
+	Children  []*SpaceNode `json:"children,omitempty"`
+}
+
+type SpaceTreeOptions struct {
+	TopLevel bool
+	MaxDepth int
+}
+
+// BuildSpaceTree resolves the public rooms into nested spaces. A child that
+// points back at one of its ancestors is marked as a cycle and not expanded.
+func BuildSpaceTree(rooms []PublicRoom, opts *SpaceTreeOptions) []*SpaceNode {
+
+	byID := make(map[string]*PublicRoom, len(rooms))
+	for i := range rooms {
+		byID[rooms[i].RoomID] = &rooms[i]
+	}
+
+	// a space is top-level if no other listed space claims it as a child
+	// and it doesn't declare a listed parent
+	claimed := map[string]bool{}
+	for _, room := range rooms {
+		for _, child := range room.Children {
+			claimed[child] = true
+		}
+	}
+
+	reached := map[string]bool{}
+
+	var build func(room *PublicRoom, path map[string]bool, depth int) *SpaceNode
+	build = func(room *PublicRoom, path map[string]bool, depth int) *SpaceNode {
+		node := &SpaceNode{PublicRoom: *room}
+		reached[room.RoomID] = true
+
+		if path[room.RoomID] {
+			node.Cycle = true
+			return node
+		}
+
+		if opts.MaxDepth > 0 && depth >= opts.MaxDepth {
+			return node
+		}
+
+		path[room.RoomID] = true
+		defer delete(path, room.RoomID)
+
+		for _, sc := range room.SpaceChildren {
+			child, ok := byID[sc.RoomID]
+			if !ok {
+				continue
+			}
+			n := build(child, path, depth+1)
+			n.Order = sc.Order
+			n.Suggested = sc.Suggested
+			node.Children = append(node.Children, n)
+		}
+
+		return node
+	}
+
+	tree := []*SpaceNode{}
+
+	// without top_level every space gets its own entry
+	if !opts.TopLevel {
+		for i := range rooms {
+			if rooms[i].Type != "m.space" {
+				continue
+			}
+			tree = append(tree, build(&rooms[i], map[string]bool{}, 0))
+		}
+		return tree
+	}
+
+	for i := range rooms {
+		room := &rooms[i]
+		if room.Type != "m.space" {
+			continue
+		}
+		if claimed[room.RoomID] || len(room.Parents) > 0 {
+			continue
+		}
+		tree = append(tree, build(room, map[string]bool{}, 0))
+	}
+
+	// spaces that only exist within a cycle have no top-level ancestor, so
+	// they're treated as top-level rather than dropped
+	for i := range rooms {
+		room := &rooms[i]
+		if room.Type != "m.space" || reached[room.RoomID] {
+			continue
+		}
+		tree = append(tree, build(room, map[string]bool{}, 0))
+	}
+
+	return tree
+}
+
+func (c *App) SpaceHierarchy() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		opts := &SpaceTreeOptions{}
+
+		if top_level := r.URL.Query().Get("top_level"); top_level != "" {
+			b, err := strconv.ParseBool(top_level)
+			if err != nil {
+				RespondWithError(w, &JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: map[string]any{
+						"errcode": "M_INVALID_PARAM",
+						"error":   "top_level must be true or false",
+					},
+				})
+				return
+			}
+			opts.TopLevel = b
+		}
+
+		if max_depth := r.URL.Query().Get("max_depth"); max_depth != "" {
+			d, err := strconv.Atoi(max_depth)
+			if err != nil || d < 0 {
+				RespondWithError(w, &JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: map[string]any{
+						"errcode": "M_INVALID_PARAM",
+						"error":   "max_depth must be a non-negative integer",
+					},
+				})
+				return
+			}
+			opts.MaxDepth = d
+		}
+
+		public_rooms, err := c.ListPublicRooms()
+		if err != nil {
+			RespondWithError(w, &JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: map[string]any{
+					"errcode": "M_UNKNOWN",
+					"error":   "Error fetching public rooms",
+				},
+			})
+			return
+		}
+
+		RespondWithJSON(w, &JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]any{
+				"spaces": BuildSpaceTree(public_rooms, opts),
+			},
+		})
+	}
+}
@@ -4,8 +4,6 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -13,10 +11,7 @@ import (
 
 func (c *App) StateProxy() http.HandlerFunc {
 
-	endpoint := fmt.Sprintf("%s/", c.Config.Matrix.Homeserver)
-	target, _ := url.Parse(endpoint)
-
-	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy := c.NewRewritingProxy(c.RewriteState)
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
@@ -1,6 +1,7 @@
 package app
 
 import (
+	"encoding/json"
 	"log"
 	"net/http"
 	"sync"
@@ -65,10 +66,41 @@ func (c *App) Sync() http.HandlerFunc {
 func (c *App) HandleBroadcast() {
 	for {
 		event := <-Broadcast
+
+		// rooms that aren't exposed are never broadcast
+		if err := c.RoomExposure(event.RoomID); err != nil {
+			continue
+		}
+
+		// events are filtered like proxied timelines, so banned, hidden and
+		// ACL denied senders are left out, and member privacy applies
+		f, err := c.NewEventFilter(event.RoomID)
+		if err != nil {
+			c.Log.Error().Msgf("Error building event filter: %v", err)
+			continue
+		}
+
+		b, err := json.Marshal(event)
+		if err != nil {
+			c.Log.Error().Msgf("Error encoding event for broadcast: %v", err)
+			continue
+		}
+
+		var sanitized map[string]any
+		if err := DecodeJSON(b, &sanitized); err != nil {
+			c.Log.Error().Msgf("Error encoding event for broadcast: %v", err)
+			continue
+		}
+
+		if !f.Visible(sanitized) || !c.Sanitizer().SanitizeEvent(sanitized) {
+			continue
+		}
+		f.Redact(sanitized)
+
 		mutex.Lock()
 		for _, client := range clients {
 			if client.Rooms[event.RoomID.String()] {
-				err := client.Conn.WriteJSON(event)
+				err := client.Conn.WriteJSON(sanitized)
 				if err != nil {
 					log.Printf("Error broadcasting to client %s: %v", client.ID, err)
 					client.Conn.Close()
@@ -79,3 +111,29 @@ func (c *App) HandleBroadcast() {
 		mutex.Unlock()
 	}
 }
+
+// UnsubscribeRoom stops broadcasting a room's events to sync clients. The
+// clients are told the room went away, and disconnected if it was the only
+// room they were following.
+func UnsubscribeRoom(room_id string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for _, client := range clients {
+		if !client.Rooms[room_id] {
+			continue
+		}
+
+		delete(client.Rooms, room_id)
+
+		err := client.Conn.WriteJSON(map[string]any{
+			"type":    "commune.room.unavailable",
+			"room_id": room_id,
+		})
+
+		if err != nil || len(client.Rooms) == 0 {
+			client.Conn.Close()
+			delete(clients, client.ID)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// VisibilityChange is a point in a room's timeline where its history
+// visibility changed.
+type VisibilityChange struct {
+	TS         int64
+	Visibility string
+}
+
+func visibilityKey(room_id string) string {
+	return fmt.Sprintf("history_visibility:%s", room_id)
+}
+
+// RecordVisibilityChange adds a m.room.history_visibility event to the room's
+// visibility timeline. Recording the same event twice is harmless.
+func (c *App) RecordVisibilityChange(room_id id.RoomID, event_id id.EventID, ts int64, visibility string) error {
+	member := fmt.Sprintf("%s|%s", event_id, visibility)
+	return c.Cache.Rooms.ZAdd(context.Background(), visibilityKey(room_id.String()), redis.Z{
+		Score:  float64(ts),
+		Member: member,
+	}).Err()
+}
+
+// VisibilityTimeline returns the known history visibility changes of a room,
+// oldest first. The first time a room is seen, the timeline is seeded from
+// the current m.room.history_visibility state event.
+func (c *App) VisibilityTimeline(room_id id.RoomID) ([]VisibilityChange, error) {
+	ctx := context.Background()
+
+	entries, err := c.Cache.Rooms.ZRangeWithScores(ctx, visibilityKey(room_id.String()), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entries) == 0 {
+		state, err := c.Matrix.State(ctx, room_id)
+		if err != nil {
+			return nil, err
+		}
+
+		ev := state[event.StateHistoryVisibility][""]
+		if ev == nil {
+			return []VisibilityChange{}, nil
+		}
+
+		visibility, _ := ev.Content.Raw["history_visibility"].(string)
+
+		err = c.RecordVisibilityChange(room_id, ev.ID, ev.Timestamp, visibility)
+		if err != nil {
+			c.Log.Error().Msgf("Couldn't record history visibility: %v", err)
+		}
+
+		return []VisibilityChange{{TS: ev.Timestamp, Visibility: visibility}}, nil
+	}
+
+	changes := make([]VisibilityChange, 0, len(entries))
+	for _, entry := range entries {
+		member, _ := entry.Member.(string)
+		_, visibility, _ := strings.Cut(member, "|")
+		changes = append(changes, VisibilityChange{
+			TS:         int64(entry.Score),
+			Visibility: visibility,
+		})
+	}
+
+	return changes, nil
+}
+
+// VisibilityAt returns the history visibility in effect at a timestamp.
+// Before the earliest known change we can't tell, so the spec default of
+// shared is assumed.
+func VisibilityAt(changes []VisibilityChange, ts int64) string {
+	i := sort.Search(len(changes), func(i int) bool {
+		return changes[i].TS > ts
+	})
+	if i == 0 {
+		return "shared"
+	}
+	return changes[i-1].Visibility
+}
+
+// EventFilter decides which events of a room may appear in public responses.
+type EventFilter struct {
+	RoomID        id.RoomID
+	Visibility    []VisibilityChange
+	MemberPrivacy string
+	Policy        *PolicyLists
+	ACL           *ServerACL
+	Hidden        *HiddenSet
+}
+
+func (c *App) NewEventFilter(room_id id.RoomID) (*EventFilter, error) {
+	visibility, err := c.VisibilityTimeline(room_id)
+	if err != nil {
+		return nil, err
+	}
+
+	acl, err := c.RoomServerACL(room_id)
+	if err != nil {
+		return nil, err
+	}
+
+	hidden, err := c.HiddenSet()
+	if err != nil {
+		return nil, err
+	}
+
+	return &EventFilter{
+		RoomID:        room_id,
+		Visibility:    visibility,
+		MemberPrivacy: c.MemberPrivacy(room_id),
+		Policy:        c.Policy,
+		ACL:           acl,
+		Hidden:        hidden,
+	}, nil
+}
+
+// ObserveVisibility learns from history visibility events that turn up in a
+// response, so that the rest of the response is judged against them.
+func (c *App) ObserveVisibility(f *EventFilter, events []map[string]any) {
+	added := false
+
+	for _, ev := range events {
+		if t, _ := ev["type"].(string); t != "m.room.history_visibility" {
+			continue
+		}
+		if _, ok := ev["state_key"]; !ok {
+			continue
+		}
+
+		content, _ := ev["content"].(map[string]any)
+		visibility, _ := content["history_visibility"].(string)
+		event_id, _ := ev["event_id"].(string)
+		ts := EventTimestamp(ev)
+
+		if visibility == "" || event_id == "" {
+			continue
+		}
+
+		err := c.RecordVisibilityChange(f.RoomID, id.EventID(event_id), ts, visibility)
+		if err != nil {
+			c.Log.Error().Msgf("Couldn't record history visibility: %v", err)
+		}
+
+		f.Visibility = append(f.Visibility, VisibilityChange{TS: ts, Visibility: visibility})
+		added = true
+	}
+
+	if added {
+		sort.SliceStable(f.Visibility, func(i, j int) bool {
+			return f.Visibility[i].TS < f.Visibility[j].TS
+		})
+	}
+}
+
+// Visible reports whether an event may be shown to anonymous users.
+func (f *EventFilter) Visible(ev map[string]any) bool {
+	sender, _ := ev["sender"].(string)
+	if f.Policy.BannedUser(sender) != nil {
+		return false
+	}
+
+	if event_id, _ := ev["event_id"].(string); f.Hidden.HidesEvent(event_id, sender) {
+		return false
+	}
+
+	// the room's current ACL applies to events sent before it, too
+	if !f.ACL.AllowsSender(sender) {
+		return false
+	}
+
+	if f.MemberPrivacy == MemberPrivacyCounts && IsMemberEvent(ev) {
+		return false
+	}
+
+	ts := EventTimestamp(ev)
+
+	if VisibilityAt(f.Visibility, ts) == "world_readable" {
+		return true
+	}
+
+	// a change to world_readable is itself visible, even though the
+	// visibility before it wasn't
+	if t, _ := ev["type"].(string); t == "m.room.history_visibility" {
+		content, _ := ev["content"].(map[string]any)
+		visibility, _ := content["history_visibility"].(string)
+		return visibility == "world_readable"
+	}
+
+	return false
+}
+
+func EventTimestamp(ev map[string]any) int64 {
+	switch ts := ev["origin_server_ts"].(type) {
+	case json.Number:
+		v, _ := ts.Int64()
+		return v
+	case float64:
+		return int64(ts)
+	}
+	return 0
+}
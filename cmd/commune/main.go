@@ -27,12 +27,14 @@ func main() {
 		Config: *config,
 	}
 
-	if len(os.Args) > 1 {
-		command := os.Args[1]
+	if flag.NArg() > 0 {
+		command := flag.Arg(0)
 
 		switch command {
 		case "join":
 			req.JoinPublicRooms = true
+		case "hide", "unhide", "hidden", "audit":
+			req.Moderation = flag.Args()
 		}
 	}
 
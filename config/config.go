@@ -9,8 +9,9 @@ import (
 
 type Config struct {
 	App struct {
-		Domain string `toml:"domain"`
-		Port   int    `toml:"port"`
+		Domain    string `toml:"domain"`
+		Port      int    `toml:"port"`
+		PublicURL string `toml:"public_url"`
 	} `toml:"app" json:"app"`
 	AppService struct {
 		ID              string `toml:"id"`
@@ -31,8 +32,10 @@ type Config struct {
 		Compress   bool   `toml:"compress"`
 	} `json:"log" toml:"log"`
 	Matrix struct {
-		Homeserver string `toml:"homeserver"`
-		ServerName string `toml:"server_name"`
+		Homeserver       string `toml:"homeserver"`
+		ServerName       string `toml:"server_name"`
+		StateConcurrency int    `toml:"state_concurrency"`
+		StateTimeout     int    `toml:"state_timeout"`
 	} `json:"matrix" toml:"matrix"`
 	Redis struct {
 		Address    string `toml:"address"`
@@ -56,6 +59,63 @@ type Config struct {
 			ExpireAfter int64 `toml:"expire_after"`
 		} `toml:"messages"`
 	} `toml:"cache"`
+	Exposure struct {
+		RequireWorldReadable  *bool    `toml:"require_world_readable"`
+		RequirePublicJoinRule bool     `toml:"require_public_join_rule"`
+		WhenIneligible        string   `toml:"when_ineligible"`
+		DisabledEndpoints     []string `toml:"disabled_endpoints"`
+		MemberPrivacy         string   `toml:"member_privacy"`
+		Rooms                 []struct {
+			RoomID            string   `toml:"room_id"`
+			DisabledEndpoints []string `toml:"disabled_endpoints"`
+			MemberPrivacy     string   `toml:"member_privacy"`
+		} `toml:"rooms"`
+	} `toml:"exposure"`
+	Admin struct {
+		AccessToken string `toml:"access_token"`
+	} `toml:"admin"`
+	Reports struct {
+		RateLimit           int64    `toml:"rate_limit"`
+		ForwardToHomeserver bool     `toml:"forward_to_homeserver"`
+		ModerationRoom      string   `toml:"moderation_room"`
+		TrustedProxies      []string `toml:"trusted_proxies"`
+	} `toml:"reports"`
+	Policy struct {
+		Lists []string `toml:"lists"`
+	} `toml:"policy"`
+	Sanitize struct {
+		StripFields       []string `toml:"strip_fields"`
+		AllowedEventTypes []string `toml:"allowed_event_types"`
+	} `toml:"sanitize"`
+	Media struct {
+		CacheDir     string `toml:"cache_dir"`
+		MaxCacheSize int64  `toml:"max_cache_size"`
+		MaxFileSize  int64  `toml:"max_file_size"`
+		MaxAge       int64  `toml:"max_age"`
+		// local image pipeline
+		MaxImageSize   int64 `toml:"max_image_size"`
+		MaxImagePixels int64 `toml:"max_image_pixels"`
+		ReencodeImages bool  `toml:"reencode_images"`
+	} `toml:"media"`
+	Activity struct {
+		MessageWindow int64 `toml:"message_window"`
+	} `toml:"activity"`
+	Pages struct {
+		Enabled       bool   `toml:"enabled"`
+		TimelineLimit int    `toml:"timeline_limit"`
+		SiteName      string `toml:"site_name"`
+	} `toml:"pages"`
+	Robots struct {
+		Allow    []string `toml:"allow"`
+		Disallow []string `toml:"disallow"`
+	} `toml:"robots"`
+	Gallery struct {
+		BackfillPages int `toml:"backfill_pages"`
+	} `toml:"gallery"`
+	Sitemap struct {
+		Schedule       string `toml:"schedule"`
+		ThreadsPerRoom int    `toml:"threads_per_room"`
+	} `toml:"sitemap"`
 }
 
 var conf Config